@@ -0,0 +1,198 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// AddressConfig configures validation of addresses of registered instances,
+// see AddressValidation.
+type AddressConfig struct {
+	// AllowLoopback accepts loopback hosts such as "localhost" and
+	// "127.0.0.1". By default they are only accepted if the Agent itself is
+	// connected to NATS over loopback, as agents on other hosts can not reach
+	// them.
+	AllowLoopback bool
+	// DetectIP replaces missing and unspecified hosts, as in ":8080" or
+	// "0.0.0.0:8080", with the IP returned by AdvertiseIP. By default such
+	// addresses are rejected.
+	DetectIP bool
+}
+
+// AdvertiseIP returns the local IP address the Agent uses to reach the NATS
+// server. Unless there is address translation on the way, it is an address
+// other hosts can reach this one on.
+func (a *Agent) AdvertiseIP() (net.IP, error) {
+	server := a.conn.ConnectedAddr()
+	if server == "" {
+		return nil, errors.New("discovery agent is not connected")
+	}
+	// Connecting a UDP socket does not send anything, it only selects the
+	// local address routed to the server.
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// instanceAddresses returns the address and endpoints an instance is
+// registered with. Without address, the address of the first endpoint is
+// used. If addresses are validated, they are normalized. The instance itself
+// is not modified.
+func (a *Agent) instanceAddresses(info *ServiceInfo) (string, []Endpoint, error) {
+	if a.addresses == nil {
+		if info.Address == "" && len(info.Endpoints) > 0 {
+			return info.Endpoints[0].Address(), info.Endpoints, nil
+		}
+		return info.Address, info.Endpoints, nil
+	}
+	var endpoints []Endpoint
+	for _, e := range info.Endpoints {
+		if e.Port == 0 {
+			return "", nil, fmt.Errorf("invalid endpoint %q of service %s: no port", e.Name, info.Name)
+		}
+		host, err := a.normalizeHost(e.Host)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid endpoint %q of service %s: %v", e.Name, info.Name, err)
+		}
+		e.Host = host
+		e.Scheme = strings.ToLower(e.Scheme)
+		endpoints = append(endpoints, e)
+	}
+	if info.Address == "" && len(endpoints) > 0 {
+		return endpoints[0].Address(), endpoints, nil
+	}
+	address, err := a.normalizeAddress(info.Address)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid address %q of service %s: %v", info.Address, info.Name, err)
+	}
+	return address, endpoints, nil
+}
+
+// normalizeAddress validates an address of the form host:port or
+// scheme://host[:port][/path] and returns it in canonical form.
+func (a *Agent) normalizeAddress(address string) (string, error) {
+	if address == "" {
+		return "", errors.New("empty address")
+	}
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return "", err
+		}
+		if u.Host == "" {
+			return "", errors.New("no host in URL")
+		}
+		host, err := a.normalizeHost(u.Hostname())
+		if err != nil {
+			return "", err
+		}
+		if u.Port() == "" {
+			u.Host = host
+			if strings.Contains(host, ":") {
+				u.Host = "[" + host + "]"
+			}
+			return u.String(), nil
+		}
+		port, err := parsePort(u.Port())
+		if err != nil {
+			return "", err
+		}
+		u.Host = net.JoinHostPort(host, port)
+		return u.String(), nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if host, err = a.normalizeHost(host); err != nil {
+		return "", err
+	}
+	if port, err = parsePort(port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// normalizeHost validates an IP address or a host name and returns it in
+// canonical form.
+func (a *Agent) normalizeHost(host string) (string, error) {
+	if host == "" {
+		return a.detectIP()
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() {
+			return a.detectIP()
+		}
+		if ip.IsLoopback() {
+			if err := a.checkLoopback(host); err != nil {
+				return "", err
+			}
+		}
+		return ip.String(), nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if !validHostname(host) {
+		return "", errors.New("invalid host name " + host)
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		if err := a.checkLoopback(host); err != nil {
+			return "", err
+		}
+	}
+	return host, nil
+}
+
+func (a *Agent) detectIP() (string, error) {
+	if !a.addresses.DetectIP {
+		return "", errors.New("no host")
+	}
+	ip, err := a.AdvertiseIP()
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+func (a *Agent) checkLoopback(host string) error {
+	if a.addresses.AllowLoopback {
+		return nil
+	}
+	if ip, err := a.AdvertiseIP(); err == nil && ip.IsLoopback() {
+		return nil
+	}
+	return errors.New("loopback host " + host + " is not reachable by other agents")
+}
+
+func parsePort(port string) (string, error) {
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return "", errors.New("invalid port " + port)
+	}
+	return strconv.FormatUint(p, 10), nil
+}
+
+// validHostname reports whether host is a valid host name as defined by RFC
+// 1123.
+func validHostname(host string) bool {
+	if len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
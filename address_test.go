@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Address validation", func() {
+	var (
+		agents testAgents
+		agent  *Agent
+	)
+
+	// The test NATS server is reached over loopback, so the detected IP is
+	// the loopback one.
+	BeforeEach(func() {
+		agent = agents.new(AddressValidation(AddressConfig{DetectIP: true}))
+	})
+
+	AfterEach(func() {
+		agents.close()
+	})
+
+	table.DescribeTable("normalizes valid addresses",
+		func(address, normalized string) {
+			Expect(agent.normalizeAddress(address)).To(Equal(normalized))
+		},
+		table.Entry("IPv4", "10.0.0.1:80", "10.0.0.1:80"),
+		table.Entry("IPv6", "[2001:0db8:0::1]:443", "[2001:db8::1]:443"),
+		table.Entry("IPv4 mapped IPv6", "[::ffff:10.0.0.1]:80", "10.0.0.1:80"),
+		table.Entry("host name", "Orders.Example.COM.:8080", "orders.example.com:8080"),
+		table.Entry("port with leading zeros", "10.0.0.1:080", "10.0.0.1:80"),
+		table.Entry("URL", "http://Orders.Example.com:080/api", "http://orders.example.com:80/api"),
+		table.Entry("URL without port", "https://[2001:db8:0::1]/api", "https://[2001:db8::1]/api"),
+		table.Entry("missing host", ":8080", "127.0.0.1:8080"),
+		table.Entry("unspecified host", "0.0.0.0:8080", "127.0.0.1:8080"),
+		table.Entry("unspecified IPv6 host", "[::]:8080", "127.0.0.1:8080"),
+		table.Entry("loopback host", "localhost:8080", "localhost:8080"),
+	)
+
+	table.DescribeTable("rejects invalid addresses",
+		func(address string) {
+			_, err := agent.normalizeAddress(address)
+			Expect(err).To(HaveOccurred())
+		},
+		table.Entry("empty", ""),
+		table.Entry("no port", "10.0.0.1"),
+		table.Entry("zero port", "10.0.0.1:0"),
+		table.Entry("port out of range", "10.0.0.1:65536"),
+		table.Entry("named port", "10.0.0.1:http"),
+		table.Entry("underscore in host name", "orders_api:80"),
+		table.Entry("label starting with a hyphen", "-orders.example.com:80"),
+		table.Entry("empty label", "orders..example.com:80"),
+		table.Entry("URL without host", "http:///api"),
+		table.Entry("URL with invalid port", "http://orders:99999/"),
+	)
+
+	It("rejects missing hosts unless they are detected", func() {
+		strict := agents.new(AddressValidation(AddressConfig{}))
+		_, err := strict.normalizeAddress(":8080")
+		Expect(err).To(HaveOccurred())
+		_, err = strict.normalizeAddress("0.0.0.0:8080")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects loopback hosts unless NATS is reached over loopback", func() {
+		disconnected := agents.new(AddressValidation(AddressConfig{}))
+		disconnected.conn.Close()
+		for _, address := range []string{"127.0.0.1:80", "[::1]:80", "localhost:80", "api.localhost:80"} {
+			_, err := disconnected.normalizeAddress(address)
+			Expect(err).To(HaveOccurred(), address)
+		}
+		_, err := agent.normalizeAddress("127.0.0.1:80")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("accepts loopback hosts with AllowLoopback", func() {
+		loopback := agents.new(AddressValidation(AddressConfig{AllowLoopback: true}))
+		loopback.conn.Close()
+		Expect(loopback.normalizeAddress("127.0.0.1:80")).To(Equal("127.0.0.1:80"))
+	})
+
+	Describe("Register", func() {
+		It("registers normalized addresses and endpoints", func() {
+			info := &ServiceInfo{
+				Name:    "orders",
+				Address: "Orders.Example.com:080",
+				Endpoints: []Endpoint{
+					{Name: "grpc", Scheme: "GRPC", Host: "0.0.0.0", Port: 9090},
+				},
+			}
+			Expect(agent.Register(info)).To(Succeed())
+			instances := agent.Discover("orders", true)
+			Expect(instances).To(HaveLen(1))
+			Expect(instances[0].Address).To(Equal("orders.example.com:80"))
+			Expect(instances[0].Endpoints).To(Equal([]Endpoint{
+				{Name: "grpc", Scheme: "grpc", Host: "127.0.0.1", Port: 9090},
+			}))
+			Expect(info.Address).To(Equal("Orders.Example.com:080"))
+			Expect(agent.Unregister(info)).To(Succeed())
+			Expect(agent.Discover("orders", true)).To(BeEmpty())
+		})
+
+		It("uses the address of the first endpoint without address", func() {
+			Expect(agent.Register(&ServiceInfo{
+				Name:      "orders",
+				Endpoints: []Endpoint{{Name: "http", Host: "10.0.0.1", Port: 8080}},
+			})).To(Succeed())
+			Expect(agent.Discover("orders", true)[0].Address).To(Equal("10.0.0.1:8080"))
+		})
+
+		It("rejects invalid endpoints without changing the instance", func() {
+			info := &ServiceInfo{
+				Name:      "orders",
+				Address:   "10.0.0.1:80",
+				Endpoints: []Endpoint{{Name: "http", Host: "10.0.0.1"}},
+			}
+			Expect(agent.Register(info)).NotTo(Succeed())
+			Expect(info.Endpoints).To(Equal([]Endpoint{{Name: "http", Host: "10.0.0.1"}}))
+			Expect(agent.Discover("orders", true)).To(BeEmpty())
+		})
+
+		It("rejects invalid addresses", func() {
+			Expect(agent.Register(&ServiceInfo{Name: "orders", Address: "orders_api:80"})).NotTo(Succeed())
+			Expect(agent.Discover("orders", true)).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,166 @@
+package discovery
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	dproto "github.com/hatobito-io/discovery/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// agentInfoTTL is the time after which an agent which does not advertise any
+// services is forgotten, unless it announces itself again.
+const agentInfoTTL = 3 * DefaultUpdateInterval
+
+// AgentInfo describes an agent. Agents announce themselves when they start and
+// when requested, see RequestAgentInfo.
+type AgentInfo struct {
+	ClientID       string
+	Hostname       string
+	PID            int
+	ProcessName    string
+	Version        string
+	StartTime      time.Time
+	UpdateInterval time.Duration
+	Labels         map[string]string
+	Locality       Locality
+	Namespace      string
+	// Incarnation changes every time the agent is restarted.
+	Incarnation uint64
+	// LastSeen is the time the agent was last heard of.
+	LastSeen time.Time
+}
+
+// libraryVersion returns the version of this module linked into the binary.
+func libraryVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	if info.Main.Path == "github.com/hatobito-io/discovery" {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == "github.com/hatobito-io/discovery" {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return ""
+}
+
+func (a *Agent) agentInfoProto() *dproto.AgentInfo {
+	hostname, _ := os.Hostname()
+	return &dproto.AgentInfo{
+		ClientId:       a.clientID,
+		Hostname:       hostname,
+		Pid:            int32(os.Getpid()),
+		ProcessName:    filepath.Base(os.Args[0]),
+		Version:        libraryVersion(),
+		StartTime:      timestamppb.New(a.startTime),
+		UpdateInterval: durationpb.New(DefaultUpdateInterval),
+		Labels:         a.labels,
+		Incarnation:    a.incarnation,
+		Locality:       a.locality.proto(),
+	}
+}
+
+func agentInfoFromProto(msg *dproto.AgentInfo) *AgentInfo {
+	info := &AgentInfo{
+		ClientID:       msg.ClientId,
+		Hostname:       msg.Hostname,
+		PID:            int(msg.Pid),
+		ProcessName:    msg.ProcessName,
+		Version:        msg.Version,
+		UpdateInterval: msg.UpdateInterval.AsDuration(),
+		Labels:         msg.Labels,
+		Incarnation:    msg.Incarnation,
+		Locality:       localityFromProto(msg.Locality),
+	}
+	if msg.StartTime != nil {
+		info.StartTime = msg.StartTime.AsTime()
+	}
+	return info
+}
+
+func (a *Agent) handleAgentInfoMessage(msg *dproto.AgentInfo, clientID, namespace string) {
+	info := agentInfoFromProto(msg)
+	info.ClientID = clientID
+	info.Namespace = namespace
+	info.LastSeen = time.Now()
+	a.lock()
+	defer a.unlock()
+	if a.agents[clientID] == nil {
+		a.log.Info("discovery: agent joined", "clientID", clientID,
+			"hostname", info.Hostname, "pid", info.PID, "process", info.ProcessName)
+	}
+	a.agents[clientID] = info
+}
+
+// handleAgentInfoRequest announces the Agent. The announcement is published
+// without the lock held, so that a slow connection does not stall other
+// handlers.
+func (a *Agent) handleAgentInfoRequest() {
+	a.lock()
+	if !a.running || !a.connected {
+		a.unlock()
+		return
+	}
+	msg := &msgWrapper{subject: a.agentInfoSubject(), msg: a.agentInfoProto()}
+	a.unlock()
+	if err := a.publishMessage(msg); err != nil {
+		a.log.Error("discovery: failed to publish message", "subject", msg.subject, "error", err)
+	}
+}
+
+// expireAgents forgets agents which do not advertise any services and have not
+// been heard of for agentInfoTTL. Must be called with the lock held.
+func (a *Agent) expireAgents(now time.Time) {
+	active := make(map[string]bool)
+	for item := a.knownServices.first; item != nil; item = item.next {
+		active[item.updatedBy] = true
+	}
+	for clientID, info := range a.agents {
+		if !active[clientID] && now.Sub(info.LastSeen) > agentInfoTTL {
+			delete(a.agents, clientID)
+		}
+	}
+}
+
+// Info returns the description of this Agent, as announced to other agents.
+func (a *Agent) Info() *AgentInfo {
+	info := agentInfoFromProto(a.agentInfoProto())
+	info.Namespace = a.namespace
+	info.LastSeen = time.Now()
+	return info
+}
+
+// Agents returns descriptions of other known agents.
+func (a *Agent) Agents() []*AgentInfo {
+	a.lock()
+	defer a.unlock()
+	ret := make([]*AgentInfo, 0, len(a.agents))
+	for _, info := range a.agents {
+		item := *info
+		ret = append(ret, &item)
+	}
+	return ret
+}
+
+// RequestAgentInfo asks all agents to announce themselves. Descriptions of
+// agents become available through Agents as their announcements arrive.
+func (a *Agent) RequestAgentInfo() error {
+	a.lock()
+	defer a.unlock()
+	if !a.running || !a.connected {
+		return errors.New("discovery agent is not running")
+	}
+	a.publish(a.agentInfoRequestSubject(), &dproto.AgentInfoRequest{})
+	return nil
+}
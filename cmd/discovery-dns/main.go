@@ -0,0 +1,68 @@
+// Command discovery-dns serves DNS queries about services discovered over
+// NATS, making them available to workloads which can not use the discovery
+// library directly.
+//
+// Usage:
+//
+//	discovery-dns [-nats URL] [-prefix PREFIX] [-namespace NS] [-listen ADDR] [-domain DOMAIN] [-watch SERVICES]
+//
+// Services listed with -watch are watched from start, other services are
+// watched when they are first queried and unwatched when not queried for
+// dns.DefaultWatchTTL.
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/hatobito-io/discovery/dns"
+	"github.com/hatobito-io/discovery/internal/cmdutil"
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	var flags cmdutil.Flags
+	flags.Register(flag.CommandLine)
+	listen := flag.String("listen", ":8053", "address to listen on (UDP and TCP)")
+	domain := flag.String("domain", dns.DefaultDomain, "DNS domain to serve")
+	watch := flag.String("watch", "", "comma separated list of services to watch from start")
+	includeLocal := flag.Bool("local", false, "include services registered by this agent")
+	flag.Parse()
+
+	agent, conn, err := flags.Connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := agent.Start(); err != nil {
+		return err
+	}
+	defer agent.Stop()
+	for _, name := range strings.Split(*watch, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			agent.Watch(name)
+		}
+	}
+
+	server := dns.NewServer(agent, *domain)
+	server.WatchOnQuery = true
+	server.IncludeLocal = *includeLocal
+	failed := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		go func(network string) {
+			failed <- server.ListenAndServe(*listen, network)
+		}(network)
+	}
+	select {
+	case err := <-failed:
+		return err
+	case <-cmdutil.Signal():
+		return nil
+	}
+}
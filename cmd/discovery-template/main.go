@@ -0,0 +1,125 @@
+// Command discovery-template renders Go text/template files from services
+// discovered over NATS and keeps them up to date, optionally running a
+// command after every change, e.g. to reload a proxy.
+//
+// Usage:
+//
+//	discovery-template [-nats URL] [-prefix PREFIX] [-namespace NS] [-wait MIN] [-max-wait MAX] [-once] -template IN:OUT[:COMMAND] ...
+//
+// Templates can use the following functions in addition to the standard ones:
+//
+//	service NAME  instances of a service, sorted by address
+//	services      names of all known services
+//
+// For example:
+//
+//	upstream orders {
+//	{{- range service "orders"}}
+//	    server {{.Address}};
+//	{{- end}}
+//	}
+//
+// Output files are replaced atomically and only when their contents change.
+// Re-rendering happens when instances of a used service change, after the set
+// of instances has been stable for MIN, but no later than MAX after the first
+// change.
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/hatobito-io/discovery"
+	"github.com/hatobito-io/discovery/internal/cmdutil"
+)
+
+type templateFlags []string
+
+func (t *templateFlags) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *templateFlags) Set(value string) error {
+	*t = append(*t, value)
+	return nil
+}
+
+func main() {
+	var flags cmdutil.Flags
+	var templates templateFlags
+	flags.Register(flag.CommandLine)
+	flag.Var(&templates, "template", "template to render as IN:OUT[:COMMAND], can be repeated")
+	wait := flag.Duration("wait", 500*time.Millisecond, "time the instances must be stable before rendering")
+	maxWait := flag.Duration("max-wait", 5*time.Second, "maximum time to delay rendering after a change")
+	initialWait := flag.Duration("initial-wait", discovery.DefaultUpdateInterval*3/2, "time to collect announcements before the first rendering")
+	once := flag.Bool("once", false, "render templates once and exit")
+	flag.Parse()
+	if len(templates) == 0 {
+		log.Fatal("at least one -template is required")
+	}
+
+	agent, conn, err := flags.Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	if err := agent.Start(); err != nil {
+		log.Fatal(err)
+	}
+	defer agent.Stop()
+
+	r := newRenderer(agent)
+	for _, spec := range templates {
+		if err := r.add(spec); err != nil {
+			log.Fatal(err)
+		}
+	}
+	changes := make(chan string, 100)
+	agent.Notify(changes)
+	defer agent.StopNotify(changes)
+
+	// Dependencies are only known after executing the templates, which is
+	// needed to start watching the services.
+	r.collect()
+	timer := time.NewTimer(*initialWait)
+	var first time.Time
+	rendered := false
+	signals := cmdutil.Signal()
+	for {
+		select {
+		case name := <-changes:
+			// Until the first render the initial wait is kept, so that
+			// instances of all services have time to arrive.
+			if !rendered || !r.uses(name) {
+				continue
+			}
+			now := time.Now()
+			if first.IsZero() {
+				first = now
+			}
+			delay := *wait
+			if deadline := first.Add(*maxWait); now.Add(delay).After(deadline) {
+				delay = deadline.Sub(now)
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(delay)
+		case <-timer.C:
+			first = time.Time{}
+			rendered = true
+			r.renderAll()
+			r.apply()
+			if *once {
+				return
+			}
+		case <-signals:
+			return
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/hatobito-io/discovery"
+)
+
+type templateFile struct {
+	in       string
+	out      string
+	command  string
+	tmpl     *template.Template
+	rendered []byte
+	dirty    bool
+}
+
+// renderer renders templates and tracks services used by them.
+type renderer struct {
+	agent *discovery.Agent
+	files []*templateFile
+	mu    sync.Mutex
+	used  map[string]bool
+}
+
+func newRenderer(agent *discovery.Agent) *renderer {
+	return &renderer{agent: agent, used: make(map[string]bool)}
+}
+
+func (r *renderer) add(spec string) error {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return errors.New("invalid template " + spec + ", expected IN:OUT[:COMMAND]")
+	}
+	f := &templateFile{in: parts[0], out: parts[1]}
+	if len(parts) == 3 {
+		f.command = parts[2]
+	}
+	tmpl, err := template.New(filepath.Base(f.in)).Funcs(template.FuncMap{
+		"service":  r.service,
+		"services": r.services,
+	}).ParseFiles(f.in)
+	if err != nil {
+		return err
+	}
+	f.tmpl = tmpl
+	if current, err := ioutil.ReadFile(f.out); err == nil {
+		f.rendered = current
+	}
+	r.files = append(r.files, f)
+	return nil
+}
+
+func (r *renderer) service(name string) []*discovery.ServiceInfo {
+	r.mu.Lock()
+	watched := r.used[name]
+	r.used[name] = true
+	r.mu.Unlock()
+	if !watched {
+		r.agent.Watch(name)
+	}
+	instances := r.agent.Discover(name, false)
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Address < instances[j].Address })
+	return instances
+}
+
+func (r *renderer) services() []string {
+	r.mu.Lock()
+	r.used[""] = true
+	r.mu.Unlock()
+	names := r.agent.Services(false)
+	sort.Strings(names)
+	return names
+}
+
+// uses reports whether a change of the service affects any template. Templates
+// may use patterns, which match several services.
+func (r *renderer) uses(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for used := range r.used {
+		if used == "" || discovery.MatchName(used, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// collect executes all templates without writing anything, to learn which
+// services they use.
+func (r *renderer) collect() {
+	for _, f := range r.files {
+		if err := f.tmpl.Execute(ioutil.Discard, nil); err != nil {
+			log.Printf("%s: %v", f.in, err)
+		}
+	}
+}
+
+// renderAll renders all templates and writes the files whose contents changed.
+func (r *renderer) renderAll() {
+	for _, f := range r.files {
+		var buf bytes.Buffer
+		if err := f.tmpl.Execute(&buf, nil); err != nil {
+			log.Printf("%s: %v", f.in, err)
+			continue
+		}
+		if bytes.Equal(buf.Bytes(), f.rendered) {
+			continue
+		}
+		if err := writeAtomic(f.out, buf.Bytes()); err != nil {
+			log.Printf("%s: %v", f.out, err)
+			continue
+		}
+		f.rendered = buf.Bytes()
+		f.dirty = true
+	}
+}
+
+// apply runs commands of the templates written since the last call.
+func (r *renderer) apply() {
+	for _, f := range r.files {
+		if !f.dirty {
+			continue
+		}
+		f.dirty = false
+		if f.command == "" {
+			continue
+		}
+		cmd := exec.Command("sh", "-c", f.command)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Printf("%s: %v", f.command, err)
+		}
+	}
+}
+
+// writeAtomic replaces the file with data by writing a temporary file in the
+// same directory and renaming it.
+func writeAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if st, err := os.Stat(path); err == nil {
+		mode = st.Mode()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
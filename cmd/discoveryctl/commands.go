@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/hatobito-io/discovery"
+	"github.com/hatobito-io/discovery/internal/cmdutil"
+)
+
+func list(agent *discovery.Agent, out *printer, wait time.Duration) error {
+	time.Sleep(wait)
+	var instances []*discovery.ServiceInfo
+	for _, name := range agent.Services(false) {
+		instances = append(instances, agent.Discover(name, false)...)
+	}
+	sortInstances(instances)
+	return out.instances(instances)
+}
+
+func watch(agent *discovery.Agent, out *printer, serviceName string) error {
+	changes := make(chan string, 100)
+	agent.Notify(changes)
+	defer agent.StopNotify(changes)
+	if err := agent.Watch(serviceName); err != nil {
+		return err
+	}
+	signals := cmdutil.Signal()
+	for {
+		select {
+		case name := <-changes:
+			if !discovery.MatchName(serviceName, name) {
+				continue
+			}
+			instances := agent.Discover(serviceName, false)
+			sortInstances(instances)
+			if err := out.change(serviceName, instances); err != nil {
+				return err
+			}
+		case <-signals:
+			return nil
+		}
+	}
+}
+
+type agentEntry struct {
+	ClientID       string            `json:"clientId"`
+	Hostname       string            `json:"hostname,omitempty"`
+	PID            int               `json:"pid,omitempty"`
+	ProcessName    string            `json:"processName,omitempty"`
+	Version        string            `json:"version,omitempty"`
+	StartTime      *time.Time        `json:"startTime,omitempty"`
+	UpdateInterval string            `json:"updateInterval,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Locality       *locality         `json:"locality,omitempty"`
+	Services       []string          `json:"services"`
+}
+
+func agents(agent *discovery.Agent, out *printer, wait time.Duration) error {
+	if err := agent.RequestAgentInfo(); err != nil {
+		return err
+	}
+	time.Sleep(wait)
+	byID := make(map[string]*agentEntry)
+	entryFor := func(clientID string) *agentEntry {
+		entry := byID[clientID]
+		if entry == nil {
+			entry = &agentEntry{ClientID: clientID, Services: []string{}}
+			byID[clientID] = entry
+		}
+		return entry
+	}
+	for _, info := range agent.Agents() {
+		entry := entryFor(info.ClientID)
+		entry.Hostname = info.Hostname
+		entry.PID = info.PID
+		entry.ProcessName = info.ProcessName
+		entry.Version = info.Version
+		entry.Locality = toLocality(info.Locality)
+		if !info.StartTime.IsZero() {
+			startTime := info.StartTime
+			entry.StartTime = &startTime
+		}
+		entry.UpdateInterval = info.UpdateInterval.String()
+		entry.Labels = info.Labels
+	}
+	for _, name := range agent.Services(false) {
+		for _, info := range agent.Discover(name, false) {
+			entry := entryFor(info.AgentID())
+			entry.Services = append(entry.Services, info.Name+" "+info.Address)
+		}
+	}
+	var entries []*agentEntry
+	for _, entry := range byID {
+		sort.Strings(entry.Services)
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ClientID < entries[j].ClientID })
+	return out.agents(entries)
+}
@@ -0,0 +1,97 @@
+// Command discoveryctl inspects the service discovery mesh.
+//
+// Usage:
+//
+//	discoveryctl [-nats URL] [-prefix PREFIX] [-namespace NS] [-o table|json] [-wait DURATION] COMMAND [ARGS]
+//
+// Commands:
+//
+//	list           list all services and their instances
+//	watch SERVICE  print instances of a service every time they change
+//	agents         list active agents, their descriptions and services they advertise
+//	tail           print decoded protocol messages
+//
+// The list and agents commands listen for announcements for the time given by
+// -wait before printing the results.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/hatobito-io/discovery"
+	"github.com/hatobito-io/discovery/internal/cmdutil"
+)
+
+func main() {
+	var flags cmdutil.Flags
+	flags.Register(flag.CommandLine)
+	output := flag.String("o", "table", "output format: table or json")
+	wait := flag.Duration("wait", discovery.DefaultUpdateInterval*3/2, "time to listen for announcements")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	out, err := newPrinter(*output)
+	if err != nil {
+		fatal(err)
+	}
+
+	var opts []discovery.Option
+	if flag.Arg(0) == "tail" {
+		opts = append(opts, discovery.Tap(out.message))
+	}
+	agent, conn, err := flags.Connect(opts...)
+	if err != nil {
+		fatal(err)
+	}
+	defer conn.Close()
+	if err := agent.Start(); err != nil {
+		fatal(err)
+	}
+	defer agent.Stop()
+
+	switch flag.Arg(0) {
+	case "list":
+		err = list(agent, out, *wait)
+	case "watch":
+		if flag.NArg() != 2 {
+			usage()
+			os.Exit(2)
+		}
+		err = watch(agent, out, flag.Arg(1))
+	case "agents":
+		err = agents(agent, out, *wait)
+	case "tail":
+		<-cmdutil.Signal()
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] list|watch SERVICE|agents|tail\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func sortInstances(instances []*discovery.ServiceInfo) {
+	sort.Slice(instances, func(i, j int) bool {
+		if instances[i].Name != instances[j].Name {
+			return instances[i].Name < instances[j].Name
+		}
+		return instances[i].Address < instances[j].Address
+	})
+}
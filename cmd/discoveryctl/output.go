@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hatobito-io/discovery"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+type locality struct {
+	Region  string `json:"region,omitempty"`
+	Zone    string `json:"zone,omitempty"`
+	Subzone string `json:"subzone,omitempty"`
+}
+
+func toLocality(l discovery.Locality) *locality {
+	if l.IsZero() {
+		return nil
+	}
+	return &locality{Region: l.Region, Zone: l.Zone, Subzone: l.Subzone}
+}
+
+type endpoint struct {
+	Name   string `json:"name,omitempty"`
+	Scheme string `json:"scheme,omitempty"`
+	Host   string `json:"host"`
+	Port   uint16 `json:"port"`
+}
+
+func toEndpoints(endpoints []discovery.Endpoint) []endpoint {
+	var ret []endpoint
+	for _, e := range endpoints {
+		ret = append(ret, endpoint{Name: e.Name, Scheme: e.Scheme, Host: e.Host, Port: e.Port})
+	}
+	return ret
+}
+
+type instance struct {
+	Name      string            `json:"name"`
+	Address   string            `json:"address"`
+	Endpoints []endpoint        `json:"endpoints,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Locality  *locality         `json:"locality,omitempty"`
+	Weight    uint32            `json:"weight"`
+	Priority  uint32            `json:"priority,omitempty"`
+	Load      float64           `json:"load,omitempty"`
+	Version   string            `json:"version,omitempty"`
+	ClientID  string            `json:"clientId"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+	GoodUntil time.Time         `json:"goodUntil"`
+}
+
+func toInstances(infos []*discovery.ServiceInfo) []instance {
+	ret := []instance{}
+	for _, info := range infos {
+		ret = append(ret, instance{
+			Name:      info.Name,
+			Address:   info.Address,
+			Endpoints: toEndpoints(info.Endpoints),
+			Namespace: info.Namespace,
+			Metadata:  info.Metadata,
+			Locality:  toLocality(info.Locality),
+			Weight:    info.Weight,
+			Priority:  info.Priority,
+			Load:      info.Load,
+			Version:   info.Version,
+			ClientID:  info.AgentID(),
+			UpdatedAt: info.UpdatedAt,
+			GoodUntil: info.GoodUntil,
+		})
+	}
+	return ret
+}
+
+// printer writes results either as JSON, one document per line, or as tables.
+type printer struct {
+	json bool
+	mu   sync.Mutex
+}
+
+func newPrinter(format string) (*printer, error) {
+	switch format {
+	case "json":
+		return &printer{json: true}, nil
+	case "table":
+		return &printer{}, nil
+	}
+	return nil, errors.New("unknown output format " + format)
+}
+
+func (p *printer) writeJSON(v interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return json.NewEncoder(os.Stdout).Encode(v)
+}
+
+func (p *printer) table(header string, rows [][]string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func (p *printer) instances(infos []*discovery.ServiceInfo) error {
+	if p.json {
+		return p.writeJSON(toInstances(infos))
+	}
+	var rows [][]string
+	for _, info := range infos {
+		rows = append(rows, []string{info.Name, info.Address, info.AgentID(), info.GoodUntil.Format(time.RFC3339)})
+	}
+	return p.table("SERVICE\tADDRESS\tAGENT\tGOOD UNTIL", rows)
+}
+
+func (p *printer) change(serviceName string, infos []*discovery.ServiceInfo) error {
+	if p.json {
+		return p.writeJSON(struct {
+			Time      time.Time  `json:"time"`
+			Service   string     `json:"service"`
+			Instances []instance `json:"instances"`
+		}{time.Now(), serviceName, toInstances(infos)})
+	}
+	addresses := make([]string, len(infos))
+	for i, info := range infos {
+		addresses[i] = info.Address
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := fmt.Printf("%s %s: %d instances [%s]\n",
+		time.Now().Format(time.RFC3339), serviceName, len(infos), strings.Join(addresses, " "))
+	return err
+}
+
+func (p *printer) agents(entries []*agentEntry) error {
+	if p.json {
+		if entries == nil {
+			entries = []*agentEntry{}
+		}
+		return p.writeJSON(entries)
+	}
+	var rows [][]string
+	for _, entry := range entries {
+		process := ""
+		if entry.PID != 0 {
+			process = fmt.Sprintf("%s[%d]", entry.ProcessName, entry.PID)
+		}
+		started := ""
+		if entry.StartTime != nil {
+			started = entry.StartTime.Format(time.RFC3339)
+		}
+		var labels []string
+		for k, v := range entry.Labels {
+			labels = append(labels, k+"="+v)
+		}
+		sort.Strings(labels)
+		rows = append(rows, []string{
+			entry.ClientID,
+			entry.Hostname,
+			process,
+			entry.Version,
+			started,
+			strings.Join(labels, ","),
+			strings.Join(entry.Services, ", "),
+		})
+	}
+	return p.table("AGENT\tHOST\tPROCESS\tVERSION\tSTARTED\tLABELS\tSERVICES", rows)
+}
+
+func (p *printer) message(msg *discovery.Message) {
+	body, err := protojson.Marshal(msg.Body)
+	if err != nil {
+		body = []byte(err.Error())
+	}
+	if p.json {
+		p.writeJSON(struct {
+			Time      time.Time       `json:"time"`
+			Subject   string          `json:"subject"`
+			Type      string          `json:"type"`
+			ClientID  string          `json:"clientId"`
+			Identity  string          `json:"identity,omitempty"`
+			Namespace string          `json:"namespace,omitempty"`
+			Body      json.RawMessage `json:"body"`
+		}{time.Now(), msg.Subject, msg.Type, msg.ClientID, msg.Identity, msg.Namespace, body})
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Printf("%s %-11s %s %s\n", time.Now().Format(time.RFC3339Nano), msg.Type, msg.ClientID, body)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hatobito-io/discovery"
+)
+
+const (
+	defaultWait = 5 * time.Minute
+	// defaultWatchTTL is the default time after which services watched
+	// because of requests are unwatched if not requested again.
+	defaultWatchTTL = 10 * time.Minute
+	// defaultMaxWatches is the default limit of services watched because of
+	// requests.
+	defaultMaxWatches = 1000
+)
+
+var errTooManyWatches = errors.New("too many watched services")
+
+type locality struct {
+	Region  string `json:"region,omitempty"`
+	Zone    string `json:"zone,omitempty"`
+	Subzone string `json:"subzone,omitempty"`
+}
+
+func toLocality(l discovery.Locality) *locality {
+	if l.IsZero() {
+		return nil
+	}
+	return &locality{Region: l.Region, Zone: l.Zone, Subzone: l.Subzone}
+}
+
+type endpoint struct {
+	Name   string `json:"name,omitempty"`
+	Scheme string `json:"scheme,omitempty"`
+	Host   string `json:"host"`
+	Port   uint16 `json:"port"`
+}
+
+func toEndpoints(endpoints []discovery.Endpoint) []endpoint {
+	var ret []endpoint
+	for _, e := range endpoints {
+		ret = append(ret, endpoint{Name: e.Name, Scheme: e.Scheme, Host: e.Host, Port: e.Port})
+	}
+	return ret
+}
+
+func fromEndpoints(endpoints []endpoint) []discovery.Endpoint {
+	var ret []discovery.Endpoint
+	for _, e := range endpoints {
+		ret = append(ret, discovery.Endpoint{Name: e.Name, Scheme: e.Scheme, Host: e.Host, Port: e.Port})
+	}
+	return ret
+}
+
+type instance struct {
+	Name      string            `json:"name"`
+	Address   string            `json:"address"`
+	Endpoints []endpoint        `json:"endpoints,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Locality  *locality         `json:"locality,omitempty"`
+	Weight    *uint32           `json:"weight,omitempty"`
+	Priority  uint32            `json:"priority,omitempty"`
+	Load      float64           `json:"load,omitempty"`
+	Version   string            `json:"version,omitempty"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+	GoodUntil time.Time         `json:"goodUntil"`
+}
+
+type serviceResponse struct {
+	Index     uint64     `json:"index"`
+	Instances []instance `json:"instances"`
+}
+
+// api serves the HTTP API. It tracks a change index per service, which is
+// used for long polling, and the services watched because of requests, which
+// are unwatched when not requested for watchTTL.
+type api struct {
+	agent      *discovery.Agent
+	watchTTL   time.Duration
+	maxWatches int
+	changes    chan string
+	mu         sync.Mutex
+	index      map[string]uint64
+	changed    chan struct{}
+	watches    map[string]*watch
+	swept      time.Time
+}
+
+// watch is a service watched because of requests.
+type watch struct {
+	active int
+	used   time.Time
+}
+
+func newAPI(agent *discovery.Agent) *api {
+	a := &api{
+		agent:      agent,
+		watchTTL:   defaultWatchTTL,
+		maxWatches: defaultMaxWatches,
+		changes:    make(chan string, 100),
+		index:      make(map[string]uint64),
+		changed:    make(chan struct{}),
+		watches:    make(map[string]*watch),
+	}
+	agent.Notify(a.changes)
+	go a.track()
+	return a
+}
+
+func (a *api) close() {
+	a.agent.StopNotify(a.changes)
+	close(a.changes)
+}
+
+func (a *api) track() {
+	for name := range a.changes {
+		a.mu.Lock()
+		a.index[name]++
+		close(a.changed)
+		a.changed = make(chan struct{})
+		a.mu.Unlock()
+	}
+}
+
+// current returns the change index of a service and a channel closed on the
+// next change of any service. The index of a pattern is the sum of the indexes
+// of the services it matches, so it changes with any of them.
+func (a *api) current(name string) (uint64, <-chan struct{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !discovery.IsPattern(name) {
+		return a.index[name], a.changed
+	}
+	var index uint64
+	for service, n := range a.index {
+		if discovery.MatchName(name, service) {
+			index += n
+		}
+	}
+	return index, a.changed
+}
+
+// watch watches the service for a request and returns a function to call when
+// the request is done. Services watched by the agent before being requested
+// are left alone.
+func (a *api) watch(name string) (func(), error) {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.swept) > a.watchTTL/10 {
+		a.swept = now
+		for service, w := range a.watches {
+			if w.active == 0 && now.Sub(w.used) > a.watchTTL {
+				delete(a.watches, service)
+				a.agent.Unwatch(service)
+			}
+		}
+	}
+	w := a.watches[name]
+	if w == nil {
+		if a.agent.Watching(name) {
+			return func() {}, nil
+		}
+		if len(a.watches) >= a.maxWatches {
+			return nil, errTooManyWatches
+		}
+		if err := a.agent.Watch(name); err != nil {
+			return nil, err
+		}
+		w = &watch{}
+		a.watches[name] = w
+	}
+	w.active++
+	w.used = now
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		w.active--
+		w.used = time.Now()
+	}, nil
+}
+
+func (a *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/v1/instances":
+		a.serveInstances(w, r)
+	case path == "/v1/services":
+		a.serveServices(w, r)
+	case strings.HasPrefix(path, "/v1/services/") && strings.HasSuffix(path, "/events"):
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/v1/services/"), "/events")
+		a.serveEvents(w, r, name)
+	case strings.HasPrefix(path, "/v1/services/"):
+		a.serveService(w, r, strings.TrimPrefix(path, "/v1/services/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *api) serveInstances(w http.ResponseWriter, r *http.Request) {
+	var req instance
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || (req.Address == "" && len(req.Endpoints) == 0) {
+		http.Error(w, "name and address or endpoints are required", http.StatusBadRequest)
+		return
+	}
+	info := &discovery.ServiceInfo{
+		Name:      req.Name,
+		Address:   req.Address,
+		Endpoints: fromEndpoints(req.Endpoints),
+		Metadata:  req.Metadata,
+		Priority:  req.Priority,
+		Load:      req.Load,
+		Version:   req.Version,
+	}
+	if req.Weight != nil {
+		info.Weight = *req.Weight
+		info.Drained = *req.Weight == 0
+	}
+	if req.Locality != nil {
+		info.Locality = discovery.Locality{
+			Region:  req.Locality.Region,
+			Zone:    req.Locality.Zone,
+			Subzone: req.Locality.Subzone,
+		}
+	}
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		if err := a.agent.Register(info); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		if err := a.agent.Unregister(info); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) serveServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	names := a.agent.Services(queryBool(r, "local"))
+	if names == nil {
+		names = []string{}
+	}
+	writeJSON(w, names)
+}
+
+func (a *api) serveService(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := a.instances(name, r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	done, err := a.watch(name)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == errTooManyWatches {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer done()
+	index, changed := a.current(name)
+	if since := r.URL.Query().Get("index"); since != "" {
+		wait := defaultWait
+		if s := r.URL.Query().Get("wait"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			wait = d
+		}
+		timeout := time.NewTimer(wait)
+		defer timeout.Stop()
+		for strconv.FormatUint(index, 10) == since {
+			select {
+			case <-changed:
+			case <-timeout.C:
+				since = ""
+			case <-r.Context().Done():
+				return
+			}
+			index, changed = a.current(name)
+		}
+	}
+	w.Header().Set("X-Discovery-Index", strconv.FormatUint(index, 10))
+	writeJSON(w, a.response(name, index, r))
+}
+
+func (a *api) serveEvents(w http.ResponseWriter, r *http.Request, name string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	if _, err := a.instances(name, r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	done, err := a.watch(name)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == errTooManyWatches {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer done()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	var sent uint64
+	first := true
+	for {
+		index, changed := a.current(name)
+		if first || index != sent {
+			data, err := json.Marshal(a.response(name, index, r))
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: instances\ndata: %s\n\n", index, data)
+			flusher.Flush()
+			sent, first = index, false
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// instances returns the instances of the service selected by the query
+// parameters of r.
+func (a *api) instances(name string, r *http.Request) ([]*discovery.ServiceInfo, error) {
+	query := r.URL.Query()
+	var infos []*discovery.ServiceInfo
+	var err error
+	if constraint := query.Get("version"); constraint != "" {
+		infos, err = a.agent.DiscoverVersion(name, constraint, queryBool(r, "local"))
+	} else {
+		infos = a.agent.Discover(name, queryBool(r, "local"))
+	}
+	if err != nil || query.Get("selector") == "" {
+		return infos, err
+	}
+	selector, err := discovery.ParseSelector(query.Get("selector"))
+	if err != nil {
+		return nil, err
+	}
+	var ret []*discovery.ServiceInfo
+	for _, info := range infos {
+		if selector.Matches(info.Metadata) {
+			ret = append(ret, info)
+		}
+	}
+	return ret, nil
+}
+
+func (a *api) response(name string, index uint64, r *http.Request) *serviceResponse {
+	resp := &serviceResponse{Index: index, Instances: []instance{}}
+	infos, _ := a.instances(name, r)
+	for _, info := range infos {
+		resp.Instances = append(resp.Instances, instance{
+			Name:      info.Name,
+			Address:   info.Address,
+			Endpoints: toEndpoints(info.Endpoints),
+			Namespace: info.Namespace,
+			Metadata:  info.Metadata,
+			Locality:  toLocality(info.Locality),
+			Weight:    &info.Weight,
+			Priority:  info.Priority,
+			Load:      info.Load,
+			Version:   info.Version,
+			UpdatedAt: info.UpdatedAt,
+			GoodUntil: info.GoodUntil,
+		})
+	}
+	return resp
+}
+
+func queryBool(r *http.Request, name string) bool {
+	b, _ := strconv.ParseBool(r.URL.Query().Get(name))
+	return b
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
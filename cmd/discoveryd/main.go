@@ -0,0 +1,102 @@
+// Command discoveryd is a sidecar daemon which runs a service discovery agent
+// and exposes it over a local HTTP/JSON API, so that services written in other
+// languages can participate in discovery.
+//
+// Usage:
+//
+//	discoveryd [-nats URL] [-prefix PREFIX] [-namespace NS] [-listen ADDR] [-region REGION] [-zone ZONE] [-subzone SUBZONE] [-validate-addresses] [-allow-loopback] [-watch-ttl DURATION] [-max-watches N]
+//
+// API:
+//
+//	POST   /v1/instances              register or update an instance
+//	DELETE /v1/instances              unregister an instance
+//	GET    /v1/services               list names of known services
+//	GET    /v1/services/NAME          list instances of a service
+//	GET    /v1/services/NAME/events   stream changes of a service (server-sent events)
+//
+// Instances are JSON objects with the fields name, address, endpoints
+// ([{"name": ..., "scheme": ..., "host": ..., "port": ...}]), metadata,
+// locality ({"region": ..., "zone": ..., "subzone": ...}), weight, priority,
+// load and version. The address defaults to the first endpoint. Weight 0 drains
+// the instance; without weight, new instances get the default weight and
+// registered ones keep theirs. Registering an instance again updates it, which
+// is how its load is reported. Unregistering only needs name and address.
+//
+// Listing instances starts watching the service. The listing returns an index
+// in the X-Discovery-Index header; passing it back as the index query
+// parameter blocks the request until the instances change or the time given
+// by the wait parameter (default 5m) passes. The local parameter includes
+// instances registered through this daemon, the version parameter selects
+// instances satisfying a semantic version constraint such as ">=2.1 <3" and
+// the selector parameter selects instances by metadata with a label selector
+// such as "env=prod,tier in (web,api),!canary". Instances registered without
+// locality get the locality given on the command line.
+//
+// Services are unwatched when no request used them for -watch-ttl (default
+// 10m). At most -max-watches (default 1000) services are watched because of
+// requests, listing further services fails with 503 Service Unavailable.
+//
+// With -validate-addresses, addresses and endpoint hosts of registered
+// instances are validated and normalized. Missing or unspecified hosts, as in
+// ":8080", are replaced with the IP address the daemon uses to reach NATS.
+// Loopback hosts are rejected unless NATS is reached over loopback as well or
+// -allow-loopback is given.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/hatobito-io/discovery"
+	"github.com/hatobito-io/discovery/internal/cmdutil"
+)
+
+func main() {
+	var flags cmdutil.Flags
+	flags.Register(flag.CommandLine)
+	listen := flag.String("listen", "127.0.0.1:8600", "address of the HTTP API")
+	var locality discovery.Locality
+	flag.StringVar(&locality.Region, "region", "", "region of the agent")
+	flag.StringVar(&locality.Zone, "zone", "", "zone of the agent")
+	flag.StringVar(&locality.Subzone, "subzone", "", "subzone of the agent")
+	validate := flag.Bool("validate-addresses", false, "validate and normalize addresses of registered instances")
+	allowLoopback := flag.Bool("allow-loopback", false, "accept loopback addresses with -validate-addresses")
+	watchTTL := flag.Duration("watch-ttl", defaultWatchTTL, "time after which services not requested are unwatched")
+	maxWatches := flag.Int("max-watches", defaultMaxWatches, "maximum number of services watched because of requests")
+	flag.Parse()
+
+	opts := []discovery.Option{discovery.AgentLocality(locality)}
+	if *validate {
+		opts = append(opts, discovery.AddressValidation(discovery.AddressConfig{
+			AllowLoopback: *allowLoopback,
+			DetectIP:      true,
+		}))
+	}
+	agent, conn, err := flags.Connect(opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	if err := agent.Start(); err != nil {
+		log.Fatal(err)
+	}
+	defer agent.Stop()
+
+	api := newAPI(agent)
+	api.watchTTL = *watchTTL
+	api.maxWatches = *maxWatches
+	defer api.close()
+	server := &http.Server{Addr: *listen, Handler: api}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	<-cmdutil.Signal()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
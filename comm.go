@@ -1,13 +1,17 @@
 package discovery
 
 import (
+	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	dproto "github.com/hatobito-io/discovery/proto"
+	"github.com/nats-io/nats.go"
 )
 
 type msgWrapper struct {
+	ctx     context.Context
 	subject string
 	msg     proto.Message
 }
@@ -19,8 +23,7 @@ func (a *Agent) publish(subject string, msg proto.Message) {
 func worker(a *Agent) {
 	ch := a.send
 	timer := time.NewTicker(DefaultUpdateInterval)
-	a.sendUpdates()
-	a.checkExpiration()
+	a.tick()
 receiving:
 	for {
 		select {
@@ -28,15 +31,23 @@ receiving:
 			if msg == nil {
 				break receiving
 			}
-			a.publishMessage(msg)
+			if err := a.publishMessage(msg); err != nil {
+				a.log.Error("discovery: failed to publish message", "subject", msg.subject, "error", err)
+			}
 		case <-timer.C:
-			a.sendUpdates()
-			a.checkExpiration()
+			a.tick()
 		}
 	}
 	timer.Stop()
 }
 
+func (a *Agent) tick() {
+	if err := a.sendUpdates(); err != nil {
+		a.log.Error("discovery: failed to send updates", "clientID", a.clientID, "error", err)
+	}
+	a.checkExpiration()
+}
+
 func (a *Agent) publishMessage(msg *msgWrapper) error {
 	var data []byte
 	if msg.msg != nil {
@@ -46,7 +57,29 @@ func (a *Agent) publishMessage(msg *msgWrapper) error {
 			return err
 		}
 	}
-	a.conn.Publish(msg.subject, data)
+	if a.loadKeyring() != nil {
+		var err error
+		data, err = a.encrypt(msg.subject, data)
+		if err != nil {
+			return err
+		}
+	}
+	if a.signed() {
+		var err error
+		data, err = a.sign(msg.subject, data)
+		if err != nil {
+			return err
+		}
+	}
+	natsMsg := &nats.Msg{
+		Subject: msg.subject,
+		Data:    data,
+		Header:  a.injectHeaders(msg.ctx),
+	}
+	if err := a.conn.PublishMsg(natsMsg); err != nil {
+		return err
+	}
+	a.countSent(msg.subject)
 	return nil
 }
 
@@ -59,9 +92,19 @@ func (a *Agent) checkExpiration() error {
 		next := item.next
 		if now.After(item.GoodUntil) {
 			a.knownServices.remove(item)
+			a.changed(item.Name)
+			atomic.AddUint64(&a.stats.expirations, 1)
+			a.log.Info("discovery: service instance expired",
+				"service", item.Name, "address", item.Address, "clientID", item.updatedBy)
 		}
 		item = next
 	}
+	a.expireAgents(now)
+	a.expireIncarnations()
+	a.replay.prune(now)
+	if a.outliers != nil {
+		a.outliers.prune(now)
+	}
 	return nil
 }
 
@@ -69,18 +112,13 @@ func (a *Agent) sendUpdates() error {
 	a.lock()
 	defer a.unlock()
 	item := a.providedServices.first
-	msg := &dproto.ServicesList{}
+	msg := &dproto.ServicesList{Incarnation: a.incarnation}
 	for item != nil {
-		s := &dproto.ServiceInfoProto{
-			Address:  item.Address,
-			ClientId: a.clientID,
-			Name:     item.Name,
-		}
-		msg.Services = append(msg.Services, s)
+		msg.Services = append(msg.Services, a.infoProto(item))
 		item = item.next
 	}
 	if len(msg.Services) > 0 {
-		a.publishMessage(&msgWrapper{
+		return a.publishMessage(&msgWrapper{
 			subject: a.serviceListSubject(),
 			msg:     msg,
 		})
@@ -0,0 +1,85 @@
+package discovery
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+
+	"github.com/golang/protobuf/proto"
+	dproto "github.com/hatobito-io/discovery/proto"
+)
+
+var errUnknownKey = errors.New("message is encrypted with unknown key")
+
+type keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+func newKeyring(activeID string, keys map[string][]byte) (*keyring, error) {
+	if _, ok := keys[activeID]; !ok {
+		return nil, errors.New("Active encryption key " + activeID + " is not in the key list")
+	}
+	ring := &keyring{active: activeID, keys: make(map[string]cipher.AEAD)}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		ring.keys[id] = aead
+	}
+	return ring, nil
+}
+
+func (a *Agent) loadKeyring() *keyring {
+	ring, _ := a.keyring.Load().(*keyring)
+	return ring
+}
+
+// encrypt seals the payload with the active key. Subject is used as additional
+// authenticated data so that the message can not be moved to another subject.
+func (a *Agent) encrypt(subject string, payload []byte) ([]byte, error) {
+	ring := a.loadKeyring()
+	aead := ring.keys[ring.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&dproto.EncryptedMessage{
+		KeyId:      ring.active,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, payload, []byte(subject)),
+	})
+}
+
+func (a *Agent) decrypt(subject string, data []byte) ([]byte, error) {
+	envelope := &dproto.EncryptedMessage{}
+	if err := proto.Unmarshal(data, envelope); err != nil {
+		return nil, err
+	}
+	aead := a.loadKeyring().keys[envelope.KeyId]
+	if aead == nil {
+		return nil, errUnknownKey
+	}
+	return aead.Open(nil, envelope.Nonce, envelope.Ciphertext, []byte(subject))
+}
+
+// SetEncryptionKeys replaces the keys used to encrypt and decrypt messages.
+// See EncryptionKeys for the description of the arguments. It can only be
+// used if the Agent was created with EncryptionKeys option.
+func (a *Agent) SetEncryptionKeys(activeID string, keys map[string][]byte) error {
+	if a.loadKeyring() == nil {
+		return errors.New("discovery agent does not use encryption")
+	}
+	ring, err := newKeyring(activeID, keys)
+	if err != nil {
+		return err
+	}
+	a.keyring.Store(ring)
+	return nil
+}
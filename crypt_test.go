@@ -0,0 +1,105 @@
+package discovery
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Encryption", func() {
+	var (
+		agents   testAgents
+		oldKey   []byte
+		newKey   []byte
+		sender   *Agent
+		receiver *Agent
+	)
+
+	BeforeEach(func() {
+		oldKey = bytes.Repeat([]byte{1}, 32)
+		newKey = bytes.Repeat([]byte{2}, 32)
+		sender = agents.new(EncryptionKeys("old", map[string][]byte{"old": oldKey}))
+		receiver = agents.new(EncryptionKeys("old", map[string][]byte{"old": oldKey}))
+	})
+
+	AfterEach(func() {
+		agents.close()
+	})
+
+	It("decrypts messages encrypted with a shared key", func() {
+		receiver.handleMessage(servicesList(sender, "orders", "10.0.0.1:80"))
+		Expect(receiver.Discover("orders", false)).To(HaveLen(1))
+		Expect(receiver.RejectedMessages()).To(BeZero())
+	})
+
+	It("does not reveal the payload", func() {
+		msg := servicesList(sender, "orders", "10.0.0.1:80")
+		Expect(string(msg.Data)).NotTo(ContainSubstring("10.0.0.1:80"))
+	})
+
+	It("rejects messages encrypted with an unknown key", func() {
+		Expect(sender.SetEncryptionKeys("new", map[string][]byte{"new": newKey})).To(Succeed())
+		receiver.handleMessage(servicesList(sender, "orders", "10.0.0.1:80"))
+		Expect(receiver.Discover("orders", false)).To(BeEmpty())
+		Expect(receiver.RejectedMessages()).To(BeEquivalentTo(1))
+	})
+
+	It("rejects messages moved to another subject", func() {
+		msg := servicesList(sender, "orders", "10.0.0.1:80")
+		msg.Subject = sender.agentInfoSubject()
+		receiver.handleMessage(msg)
+		Expect(receiver.RejectedMessages()).To(BeEquivalentTo(1))
+	})
+
+	It("rotates keys without losing messages", func() {
+		both := map[string][]byte{"old": oldKey, "new": newKey}
+		By("distributing the new key")
+		Expect(receiver.SetEncryptionKeys("old", both)).To(Succeed())
+		Expect(sender.SetEncryptionKeys("old", both)).To(Succeed())
+		receiver.handleMessage(servicesList(sender, "orders", "10.0.0.1:80"))
+
+		By("activating the new key on the sender first")
+		Expect(sender.SetEncryptionKeys("new", both)).To(Succeed())
+		receiver.handleMessage(servicesList(sender, "orders", "10.0.0.2:80"))
+		Expect(receiver.Discover("orders", false)).To(HaveLen(2))
+
+		By("removing the old key")
+		Expect(sender.SetEncryptionKeys("new", map[string][]byte{"new": newKey})).To(Succeed())
+		Expect(receiver.SetEncryptionKeys("new", map[string][]byte{"new": newKey})).To(Succeed())
+		receiver.handleMessage(servicesList(sender, "orders", "10.0.0.3:80"))
+		Expect(receiver.Discover("orders", false)).To(HaveLen(3))
+		Expect(receiver.RejectedMessages()).To(BeZero())
+
+		_, err := receiver.decrypt("subject", mustEncrypt(agents.new(EncryptionKeys("old", both)), "subject"))
+		Expect(err).To(Equal(errUnknownKey))
+	})
+
+	It("encrypts with the active key", func() {
+		Expect(sender.SetEncryptionKeys("new", map[string][]byte{"old": oldKey, "new": newKey})).To(Succeed())
+		Expect(sender.loadKeyring().active).To(Equal("new"))
+		Expect(receiver.SetEncryptionKeys("old", map[string][]byte{"old": oldKey})).To(Succeed())
+		_, err := receiver.decrypt("subject", mustEncrypt(sender, "subject"))
+		Expect(err).To(Equal(errUnknownKey))
+	})
+
+	It("requires the active key in the key list", func() {
+		Expect(sender.SetEncryptionKeys("missing", map[string][]byte{"new": newKey})).NotTo(Succeed())
+		Expect(sender.loadKeyring().active).To(Equal("old"))
+	})
+
+	It("rejects keys of invalid length", func() {
+		Expect(sender.SetEncryptionKeys("short", map[string][]byte{"short": {1, 2, 3}})).NotTo(Succeed())
+	})
+
+	It("can not be enabled by SetEncryptionKeys", func() {
+		plain := agents.new()
+		Expect(plain.SetEncryptionKeys("new", map[string][]byte{"new": newKey})).NotTo(Succeed())
+	})
+})
+
+func mustEncrypt(a *Agent, subject string) []byte {
+	data, err := a.encrypt(subject, []byte("payload"))
+	Expect(err).NotTo(HaveOccurred())
+	return data
+}
@@ -1,14 +1,21 @@
 package discovery
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/Masterminds/semver/v3"
 	dproto "github.com/hatobito-io/discovery/proto"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // DefaultSubjectPrefix is the default subject prefix for messages sent by
@@ -23,18 +30,43 @@ const DefaultUpdateInterval = time.Millisecond * 1000
 
 // Agent is a service discovery agent.
 type Agent struct {
+	stats            agentStats
 	conn             *nats.Conn
 	subjectPrefix    string
 	prefixParts      int
 	knownServices    *infoList
 	providedServices *infoList
-	subs             *nats.Subscription
+	subs             []*nats.Subscription
 	watched          map[string]bool
+	filters          map[string][]func(*ServiceInfo) bool
+	notify           map[chan<- string]bool
+	agents           map[string]*AgentInfo
+	labels           map[string]string
+	namespace        string
+	namespaces       []string
+	locality         Locality
+	startTime        time.Time
+	incarnation      uint64
+	incarnations     map[string]uint64
 	connected        bool
 	running          bool
 	l                chan struct{}
 	send             chan *msgWrapper
 	clientID         string
+	signingKey       nkeys.KeyPair
+	signingPub       string
+	trustedKeys      map[string]bool
+	replay           *replayGuard
+	owners           map[string]string
+	policy           Policy
+	onUnauthorized   func(identity string, info *ServiceInfo)
+	keyring          atomic.Value
+	log              Logger
+	tracerProvider   trace.TracerProvider
+	textPropagator   propagation.TextMapPropagator
+	tap              func(*Message)
+	outliers         *outlierDetector
+	addresses        *AddressConfig
 }
 
 func (a *Agent) lock() {
@@ -53,56 +85,120 @@ func NewAgent(conn *nats.Conn, opts ...Option) (*Agent, error) {
 		knownServices:    &infoList{},
 		providedServices: &infoList{},
 		watched:          make(map[string]bool),
+		filters:          make(map[string][]func(*ServiceInfo) bool),
+		notify:           make(map[chan<- string]bool),
+		agents:           make(map[string]*AgentInfo),
+		startTime:        time.Now(),
+		incarnations:     make(map[string]uint64),
+		replay:           newReplayGuard(),
+		owners:           make(map[string]string),
 		l:                make(chan struct{}, 1),
+		log:              nopLogger{},
 	}
 	var cid [16]byte
 	if _, err := rand.Read(cid[:]); err != nil {
 		return nil, err
 	}
 
-	s.prefixParts = len(strings.Split(s.subjectPrefix, "."))
 	s.clientID = hex.EncodeToString(cid[:])
+	s.incarnation = uint64(s.startTime.UnixNano())
 	for _, opt := range opts {
 		if err := opt(s); err != nil {
 			return nil, err
 		}
 	}
+	if s.policy != nil && s.trustedKeys == nil {
+		return nil, errors.New("Publish policy requires trusted keys")
+	}
+	s.prefixParts = len(strings.Split(s.subjectPrefix, "."))
 	go s.ConnStateHandler(conn)
 	return s, nil
 }
 
 // Register registers a service instance making it available
-// for discovery by other services.
+// for discovery by other services. Instances without locality get the
+// locality of the Agent, instances without weight get DefaultWeight.
+// Registering an already registered instance updates its attributes, except
+// that weight 0 keeps the current weight. Instances registered with Drained
+// get weight 0, so they are announced drained from the start. The version, if
+// given, must be a valid semantic version. Instances are registered in the
+// namespace of the Agent. Instances without address get the address of their
+// first endpoint. With AddressValidation, the address and endpoints are
+// validated and normalized. The Agent keeps a copy of info, so later changes
+// of info have no effect.
 func (a *Agent) Register(info *ServiceInfo) error {
+	address, endpoints, err := a.instanceAddresses(info)
+	if err != nil {
+		return err
+	}
+	if info.Version != "" {
+		if _, err := semver.NewVersion(info.Version); err != nil {
+			return err
+		}
+	}
+	if info.Namespace != "" && info.Namespace != a.namespace {
+		return errors.New("can not register service " + info.Name + " in namespace " + info.Namespace +
+			", the agent is in namespace " + a.namespace)
+	}
+	instance := *info
+	instance.Address = address
+	instance.Endpoints = endpoints
+	instance.Namespace = a.namespace
+	instance.updatedBy = ""
+	instance.next = nil
+	instance.prev = nil
 	a.lock()
 	defer a.unlock()
-	item := a.providedServices.find(info)
+	if instance.Locality.IsZero() {
+		instance.Locality = a.locality
+	}
+	item := a.findProvided(&instance)
+	if instance.Drained {
+		instance.Weight = 0
+		instance.Drained = false
+	} else if instance.Weight == 0 {
+		instance.Weight = DefaultWeight
+		if item != nil {
+			instance.Weight = item.Weight
+		}
+	}
 	if item != nil {
-		item.Address = info.Address
-		item.Name = info.Name
+		if item.update(&instance) {
+			a.changed(item.Name)
+		}
 	} else {
-		a.providedServices.insert(info)
+		item = &instance
+		item.FirstSeen = time.Now()
+		a.providedServices.insert(item)
+		a.changed(item.Name)
 	}
+	a.announce(item)
+	return nil
+}
+
+// announce sends the description of a local instance to other agents without
+// waiting for the next update. Must be called with the lock held.
+func (a *Agent) announce(info *ServiceInfo) {
 	if a.running && a.connected {
 		a.send <- &msgWrapper{
 			subject: a.serviceListSubject(),
-			msg: &dproto.ServicesList{Services: []*dproto.ServiceInfoProto{
-				{
-					Address: info.Address,
-					Name:    info.Name,
-				},
-			}},
+			msg: &dproto.ServicesList{
+				Incarnation: a.incarnation,
+				Services:    []*dproto.ServiceInfoProto{a.infoProto(info)},
+			},
 		}
 	}
-
-	return nil
 }
 
 // Unregister removes a service instance making it unavailable
 // for discovery by other services.
 func (a *Agent) Unregister(info *ServiceInfo) error {
-	if item := a.providedServices.find(info); item != nil {
+	key := a.providedKey(info)
+	a.lock()
+	defer a.unlock()
+	if item := a.findProvided(key); item != nil {
 		a.providedServices.remove(item)
+		a.changed(item.Name)
 	}
 	return nil
 }
@@ -114,11 +210,17 @@ func (a *Agent) Start() error {
 	if a.running {
 		return errors.New("discovery agent is already running")
 	}
-	subs, err := a.conn.Subscribe(a.subjectPrefix+".>", a.handleMessage)
-	if err != nil {
-		return err
+	for _, subject := range a.subscriptionSubjects() {
+		sub, err := a.conn.Subscribe(subject, a.handleMessage)
+		if err != nil {
+			for _, sub := range a.subs {
+				sub.Unsubscribe()
+			}
+			a.subs = nil
+			return err
+		}
+		a.subs = append(a.subs, sub)
 	}
-	a.subs = subs
 	a.running = true
 	if a.connected {
 		a.startStopWorker(true)
@@ -137,51 +239,116 @@ func (a *Agent) Stop() error {
 		return errors.New("discovery agent is not running")
 	}
 	a.running = false
-	a.subs.Unsubscribe()
+	for _, sub := range a.subs {
+		sub.Unsubscribe()
+	}
 	a.subs = nil
+	for item := a.knownServices.first; item != nil; item = item.next {
+		a.changed(item.Name)
+	}
 	a.knownServices.clear()
+	a.agents = make(map[string]*AgentInfo)
+	a.incarnations = make(map[string]uint64)
 	if a.connected {
-		a.publish(a.stopSubject(), nil)
+		a.publish(a.stopSubject(), &dproto.AgentStopped{AgentId: a.clientID, Incarnation: a.incarnation})
 		a.startStopWorker(false)
 	}
 	return nil
 }
 
 // Watch expresses interest in particular service. Only watched services will be
-// available for discovery.
+// available for discovery. The name may be a pattern with NATS wildcards: "*"
+// matches a single dot separated token, e.g. "payments.*", and ">" matches one
+// or more tokens at the end, so ">" watches everything.
 func (a *Agent) Watch(serviceName string) error {
+	return a.WatchContext(context.Background(), serviceName)
+}
+
+// WatchContext is like Watch, but the interest message sent to other agents
+// carries the trace context of ctx, so their replies are traced as well.
+func (a *Agent) WatchContext(ctx context.Context, serviceName string) error {
+	ctx, span := a.tracer().Start(ctx, "discovery.Watch",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attrService.String(serviceName), attrClientID.String(a.clientID)))
+	defer span.End()
+	if err := validPattern(serviceName); err != nil {
+		return err
+	}
 	a.lock()
 	defer a.unlock()
+	delete(a.filters, serviceName)
+	a.watch(ctx, serviceName)
+	return nil
+}
+
+// watch starts watching the service and asks other agents for its instances.
+// Must be called with the lock held.
+func (a *Agent) watch(ctx context.Context, serviceName string) {
 	if a.watched[serviceName] {
-		return nil
+		return
 	}
 	a.watched[serviceName] = true
 	if a.connected && a.running {
-		msg := &dproto.ServiceInterest{ServiceName: []string{serviceName}}
-		a.publish(a.interestSubject(), msg)
+		a.sendInterest(ctx, []string{serviceName})
 	}
-	return nil
 }
 
-// Unwatch stops monitoring of particular service availability.
+// sendInterest asks other agents for instances of the services. Must be called
+// with the lock held.
+func (a *Agent) sendInterest(ctx context.Context, serviceNames []string) {
+	msg := &dproto.ServiceInterest{ServiceName: serviceNames, Incarnation: a.incarnation}
+	for _, subject := range a.interestSubjects() {
+		a.send <- &msgWrapper{ctx: ctx, subject: subject, msg: msg}
+	}
+}
+
+// Unwatch stops monitoring of particular service availability. The name must be
+// the same as given to Watch. Services still matched by other watched patterns
+// stay available.
 func (a *Agent) Unwatch(serviceName string) {
 	a.lock()
 	defer a.unlock()
+	delete(a.watched, serviceName)
+	delete(a.filters, serviceName)
 	item := a.knownServices.first
 	for item != nil {
 		next := item.next
-		if item.Name == serviceName {
+		if MatchName(serviceName, item.Name) && !a.isWatched(item.Name) {
 			a.knownServices.remove(item)
+			a.changed(item.Name)
 		}
 		item = next
 	}
-	delete(a.watched, serviceName)
+}
+
+// Watching reports whether the service name or pattern is watched, i.e. it was
+// given to Watch and not to Unwatch since.
+func (a *Agent) Watching(serviceName string) bool {
+	a.lock()
+	defer a.unlock()
+	return a.watched[serviceName]
 }
 
 // Discover returns a list of last known addresses of a service. If includeLocal
 // is false, the services registered by this instance of Agent using Register()
-// will be omitted.
+// will be omitted. The name may be a pattern with NATS wildcards, see Watch.
 func (a *Agent) Discover(serviceName string, includeLocal bool) []*ServiceInfo {
+	return a.discover(serviceName, includeLocal)
+}
+
+// DiscoverContext is like Discover, but records a span as a child of ctx.
+func (a *Agent) DiscoverContext(ctx context.Context, serviceName string, includeLocal bool) []*ServiceInfo {
+	_, span := a.tracer().Start(ctx, "discovery.Discover",
+		trace.WithAttributes(attrService.String(serviceName), attrClientID.String(a.clientID)))
+	defer span.End()
+	ret := a.discover(serviceName, includeLocal)
+	span.SetAttributes(attrInstances.Int(len(ret)), attribute.Bool("discovery.include_local", includeLocal))
+	return ret
+}
+
+func (a *Agent) discover(serviceName string, includeLocal bool) []*ServiceInfo {
+	a.lock()
+	defer a.unlock()
 	var ret []*ServiceInfo
 	var lists []*infoList
 	if includeLocal {
@@ -192,7 +359,7 @@ func (a *Agent) Discover(serviceName string, includeLocal bool) []*ServiceInfo {
 	for _, list := range lists {
 		s := list.first
 		for s != nil {
-			if s.Name == serviceName {
+			if MatchName(serviceName, s.Name) {
 				item := *s
 				ret = append(ret, &item)
 			}
@@ -224,16 +391,40 @@ func (a *Agent) startStopWorker(start bool) {
 	if start {
 		a.send = make(chan *msgWrapper, 10)
 		go worker(a)
-		watchedServices := make([]string, len(a.watched))
+		watchedServices := make([]string, 0, len(a.watched))
 		for serviceName := range a.watched {
 			watchedServices = append(watchedServices, serviceName)
 		}
+		a.sendInterest(nil, watchedServices)
 		a.send <- &msgWrapper{
-			subject: a.interestSubject(),
-			msg:     &dproto.ServiceInterest{ServiceName: watchedServices},
+			subject: a.agentInfoSubject(),
+			msg:     a.agentInfoProto(),
 		}
 	} else {
 		close(a.send)
 		a.send = nil
 	}
 }
+
+// Services returns names of all services with known instances. If includeLocal
+// is false, the services registered by this instance of Agent using Register()
+// will be omitted.
+func (a *Agent) Services(includeLocal bool) []string {
+	a.lock()
+	defer a.unlock()
+	var ret []string
+	seen := make(map[string]bool)
+	lists := []*infoList{a.knownServices}
+	if includeLocal {
+		lists = append(lists, a.providedServices)
+	}
+	for _, list := range lists {
+		for item := list.first; item != nil; item = item.next {
+			if !seen[item.Name] {
+				seen[item.Name] = true
+				ret = append(ret, item.Name)
+			}
+		}
+	}
+	return ret
+}
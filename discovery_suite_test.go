@@ -0,0 +1,80 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	dproto "github.com/hatobito-io/discovery/proto"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDiscovery(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Discovery Suite")
+}
+
+var natsServer *server.Server
+
+var _ = BeforeSuite(func() {
+	var err error
+	natsServer, err = server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	Expect(err).NotTo(HaveOccurred())
+	go natsServer.Start()
+	Expect(natsServer.ReadyForConnections(5 * time.Second)).To(BeTrue())
+})
+
+var _ = AfterSuite(func() {
+	natsServer.Shutdown()
+})
+
+// testAgents creates agents connected to the test NATS server and closes their
+// connections after the spec.
+type testAgents struct {
+	conns []*nats.Conn
+}
+
+func (t *testAgents) new(opts ...Option) *Agent {
+	conn, err := nats.Connect(natsServer.ClientURL())
+	Expect(err).NotTo(HaveOccurred())
+	t.conns = append(t.conns, conn)
+	agent, err := NewAgent(conn, opts...)
+	Expect(err).NotTo(HaveOccurred())
+	return agent
+}
+
+func (t *testAgents) close() {
+	for _, conn := range t.conns {
+		conn.Close()
+	}
+	t.conns = nil
+}
+
+// message returns msg as published by the sender on subject, encrypted and
+// signed as the sender is configured to.
+func message(sender *Agent, subject string, msg proto.Message) *nats.Msg {
+	data, err := proto.Marshal(msg)
+	Expect(err).NotTo(HaveOccurred())
+	if sender.loadKeyring() != nil {
+		data, err = sender.encrypt(subject, data)
+		Expect(err).NotTo(HaveOccurred())
+	}
+	if sender.signed() {
+		data, err = sender.sign(subject, data)
+		Expect(err).NotTo(HaveOccurred())
+	}
+	return &nats.Msg{Subject: subject, Data: data}
+}
+
+// servicesList returns a message announcing an instance of the service.
+func servicesList(sender *Agent, name, address string) *nats.Msg {
+	return message(sender, sender.serviceListSubject(), &dproto.ServicesList{
+		Incarnation: sender.incarnation,
+		Services: []*dproto.ServiceInfoProto{
+			{Name: name, Address: address, ClientId: sender.clientID},
+		},
+	})
+}
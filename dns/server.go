@@ -0,0 +1,338 @@
+// Package dns provides a DNS server answering queries about services known to
+// a service discovery agent, for workloads which can not use the agent
+// directly.
+//
+// A service named "orders" is available as "orders.service.<domain>". A and
+// AAAA queries are answered with addresses of instances registered with IP
+// addresses, SRV queries are answered with all instances. SRV targets of
+// instances registered with IP addresses have the form "<hex ip>.addr.<domain>"
+// and are resolvable by the server as well. SRV records carry priorities and
+// weights of the instances.
+//
+// Named endpoints of instances are available in the RFC 2782 form, e.g. the
+// "grpc" endpoint of "orders" as "_grpc._tcp.orders.service.<domain>". Such
+// queries are answered with instances having the endpoint, using the addresses
+// of all its endpoints with the name, so that an endpoint listening on both
+// IPv4 and IPv6 gets both A and AAAA records.
+//
+// DNS names are case-insensitive, so service and endpoint names are matched
+// regardless of case. Negative answers carry the SOA record of the domain, so
+// that resolvers can cache them for NegativeTTL.
+package dns
+
+import (
+	"encoding/hex"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hatobito-io/discovery"
+	"github.com/miekg/dns"
+)
+
+// DefaultDomain is the default domain served by Server.
+const DefaultDomain = "disco."
+
+const (
+	// DefaultWatchTTL is the default time after which services watched
+	// because of queries are unwatched if not queried again.
+	DefaultWatchTTL = 10 * time.Minute
+	// DefaultMaxWatches is the default limit of services watched because of
+	// queries.
+	DefaultMaxWatches = 1000
+)
+
+// Server answers DNS queries from services known to a discovery.Agent.
+type Server struct {
+	// IncludeLocal makes the server answer with instances registered by the
+	// agent itself.
+	IncludeLocal bool
+	// WatchOnQuery makes the server Watch services it is queried about.
+	// Otherwise only services watched by the application are known. Such
+	// services are unwatched when not queried for WatchTTL. Services watched
+	// by the application before being queried are left alone.
+	WatchOnQuery bool
+	// WatchTTL is how long services watched because of queries stay
+	// watched after the last query.
+	WatchTTL time.Duration
+	// MaxWatches limits the number of services watched because of queries.
+	// Queries about other services are answered only if the application
+	// watches them.
+	MaxWatches int
+	// LocalTTL is the TTL of records for local instances, which do not
+	// expire.
+	LocalTTL time.Duration
+	// NegativeTTL is how long resolvers may cache answers telling that a
+	// name or record does not exist. It should be short, as instances of
+	// services watched because of a query are only known after a while.
+	NegativeTTL time.Duration
+	agent       *discovery.Agent
+	domain      string
+	mu          sync.Mutex
+	watched     map[string]time.Time
+	swept       time.Time
+}
+
+// NewServer creates a Server answering queries for names in domain. If domain
+// is empty, DefaultDomain is used.
+func NewServer(agent *discovery.Agent, domain string) *Server {
+	if domain == "" {
+		domain = DefaultDomain
+	}
+	return &Server{
+		WatchTTL:    DefaultWatchTTL,
+		MaxWatches:  DefaultMaxWatches,
+		LocalTTL:    discovery.DefaultUpdateInterval,
+		NegativeTTL: discovery.DefaultUpdateInterval,
+		agent:       agent,
+		domain:      dns.CanonicalName(domain),
+		watched:     make(map[string]time.Time),
+	}
+}
+
+// ListenAndServe starts serving DNS on the given address and network ("udp"
+// or "tcp"). It blocks until the server fails.
+func (s *Server) ListenAndServe(addr, network string) error {
+	server := &dns.Server{Addr: addr, Net: network, Handler: s}
+	return server.ListenAndServe()
+}
+
+// ServeDNS implements dns.Handler.
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	inDomain := false
+	for _, q := range r.Question {
+		name := dns.CanonicalName(q.Name)
+		inDomain = inDomain || dns.IsSubDomain(s.domain, name)
+		switch {
+		case dns.IsSubDomain("addr."+s.domain, name):
+			s.answerAddr(m, q, name)
+		case dns.IsSubDomain("service."+s.domain, name):
+			s.answerService(m, q, name)
+		default:
+			m.Rcode = dns.RcodeNameError
+		}
+	}
+	if inDomain && (m.Rcode == dns.RcodeNameError || len(m.Answer) == 0) {
+		m.Ns = append(m.Ns, s.soa())
+	}
+	w.WriteMsg(m)
+}
+
+// soa returns the SOA record of the domain, which is added to negative
+// answers. Resolvers cache negative answers for the smaller of its TTL and
+// Minttl. The other timers only matter for zone transfers, which are not
+// supported.
+func (s *Server) soa() dns.RR {
+	ttl := uint32(math.Ceil(s.NegativeTTL.Seconds()))
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: s.domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "ns." + s.domain,
+		Mbox:    "hostmaster." + s.domain,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
+
+// answerService answers a query for a service. name is the canonical, lower
+// case, form of the query name; the service name is taken from the query as
+// asked, so that it can be watched with the case used by the client.
+func (s *Server) answerService(m *dns.Msg, q dns.Question, name string) {
+	asked := dns.Fqdn(q.Name)
+	serviceName := strings.TrimSuffix(asked[:len(asked)-len("service."+s.domain)], ".")
+	endpoint, serviceName := splitEndpoint(serviceName)
+	if serviceName == "" || discovery.IsPattern(serviceName) {
+		m.Rcode = dns.RcodeNameError
+		return
+	}
+	if s.WatchOnQuery {
+		s.watch(serviceName)
+	}
+	instances := s.discover(serviceName)
+	ttl := s.ttl(instances)
+	for _, info := range instances {
+		for _, address := range info.EndpointAddresses(endpointName(info, endpoint)) {
+			s.answerInstance(m, q, name, info, address, ttl)
+		}
+	}
+}
+
+// discover returns the instances of all services whose names are equal to
+// serviceName regardless of case.
+func (s *Server) discover(serviceName string) []*discovery.ServiceInfo {
+	var ret []*discovery.ServiceInfo
+	for _, name := range s.agent.Services(s.IncludeLocal) {
+		if strings.EqualFold(name, serviceName) {
+			ret = append(ret, s.agent.Discover(name, s.IncludeLocal)...)
+		}
+	}
+	return ret
+}
+
+// endpointName returns the name of the endpoint of the instance equal to name
+// regardless of case. Other names are returned as is.
+func endpointName(info *discovery.ServiceInfo, name string) string {
+	for _, e := range info.Endpoints {
+		if strings.EqualFold(e.Name, name) {
+			return e.Name
+		}
+	}
+	return name
+}
+
+// answerInstance adds records for one address of the instance. A and AAAA
+// queries are only answered with addresses of the matching family.
+func (s *Server) answerInstance(m *dns.Msg, q dns.Question, name string, info *discovery.ServiceInfo, address string, ttl uint32) {
+	host, port := splitAddress(address)
+	ip := net.ParseIP(host)
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeANY:
+		if rr := addressRecord(name, ip, q.Qtype, ttl); rr != nil {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if (q.Qtype == dns.TypeSRV || q.Qtype == dns.TypeANY) && port != 0 {
+		target := dns.Fqdn(host)
+		if ip != nil {
+			target = hex.EncodeToString(ipBytes(ip)) + ".addr." + s.domain
+			if rr := addressRecord(target, ip, dns.TypeANY, ttl); rr != nil {
+				m.Extra = append(m.Extra, rr)
+			}
+		}
+		m.Answer = append(m.Answer, &dns.SRV{
+			Hdr:      dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+			Priority: clampUint16(info.Priority),
+			Weight:   clampUint16(info.Weight),
+			Port:     port,
+			Target:   target,
+		})
+	}
+}
+
+func (s *Server) answerAddr(m *dns.Msg, q dns.Question, name string) {
+	label := strings.TrimSuffix(name, ".addr."+s.domain)
+	raw, err := hex.DecodeString(label)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		m.Rcode = dns.RcodeNameError
+		return
+	}
+	if rr := addressRecord(name, net.IP(raw), q.Qtype, uint32(s.LocalTTL/time.Second)); rr != nil {
+		m.Answer = append(m.Answer, rr)
+	}
+}
+
+// watch watches the service on behalf of a query and unwatches services which
+// were not queried for WatchTTL.
+func (s *Server) watch(serviceName string) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) > s.WatchTTL/10 {
+		s.swept = now
+		for name, queried := range s.watched {
+			if now.Sub(queried) > s.WatchTTL {
+				delete(s.watched, name)
+				s.agent.Unwatch(name)
+			}
+		}
+	}
+	if _, ok := s.watched[serviceName]; ok {
+		s.watched[serviceName] = now
+		return
+	}
+	if len(s.watched) >= s.MaxWatches || s.agent.Watching(serviceName) {
+		return
+	}
+	if s.agent.Watch(serviceName) == nil {
+		s.watched[serviceName] = now
+	}
+}
+
+// ttl returns the TTL for records of the instances, which is the time left
+// until the earliest expiration.
+func (s *Server) ttl(instances []*discovery.ServiceInfo) uint32 {
+	now := time.Now()
+	ttl := math.MaxUint32 * time.Second
+	for _, info := range instances {
+		left := s.LocalTTL
+		if !info.GoodUntil.IsZero() {
+			left = info.GoodUntil.Sub(now)
+		}
+		if left < ttl {
+			ttl = left
+		}
+	}
+	if ttl < 0 {
+		return 0
+	}
+	return uint32(math.Ceil(ttl.Seconds()))
+}
+
+func addressRecord(name string, ip net.IP, qtype uint16, ttl uint32) dns.RR {
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if qtype != dns.TypeA && qtype != dns.TypeANY {
+			return nil
+		}
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   ip4,
+		}
+	}
+	if qtype != dns.TypeAAAA && qtype != dns.TypeANY {
+		return nil
+	}
+	return &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+		AAAA: ip,
+	}
+}
+
+func ipBytes(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func clampUint16(v uint32) uint16 {
+	if v > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return uint16(v)
+}
+
+// splitEndpoint splits a name of the form _endpoint._proto.service into the
+// endpoint name and the service name. Names without the endpoint prefix are
+// returned as the service name.
+func splitEndpoint(name string) (string, string) {
+	labels := strings.SplitN(name, ".", 3)
+	if len(labels) < 3 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+		return "", name
+	}
+	return labels[0][1:], labels[2]
+}
+
+// splitAddress splits an address of the form host:port. Addresses without a
+// port are returned with zero port.
+func splitAddress(address string) (string, uint16) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return address, 0
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return host, 0
+	}
+	return host, uint16(port)
+}
@@ -0,0 +1,123 @@
+package discovery
+
+import (
+	"net"
+	"strconv"
+
+	dproto "github.com/hatobito-io/discovery/proto"
+)
+
+// Endpoint is one of the addresses a service instance can be reached on, e.g.
+// its gRPC, HTTP or metrics port.
+type Endpoint struct {
+	// Name identifies the endpoint among the endpoints of the instance, e.g.
+	// "grpc" or "metrics".
+	Name string
+	// Scheme is the protocol of the endpoint, e.g. "http". It is optional.
+	Scheme string
+	// Host is an IPv4 or IPv6 address or a host name.
+	Host string
+	Port uint16
+}
+
+// Address returns the endpoint in the form host:port.
+func (e *Endpoint) Address() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(int(e.Port)))
+}
+
+// String returns the endpoint as scheme://host:port, or host:port if it has no
+// scheme.
+func (e *Endpoint) String() string {
+	if e.Scheme == "" {
+		return e.Address()
+	}
+	return e.Scheme + "://" + e.Address()
+}
+
+// Endpoint returns the endpoint of the instance with the given name, or nil if
+// there is none. Several endpoints may have the same name, e.g. for IPv4 and
+// IPv6 addresses, in which case the first one is returned.
+func (s *ServiceInfo) Endpoint(name string) *Endpoint {
+	for i := range s.Endpoints {
+		if s.Endpoints[i].Name == name {
+			return &s.Endpoints[i]
+		}
+	}
+	return nil
+}
+
+// NamedEndpoints returns all endpoints of the instance with the given name, e.g.
+// its IPv4 and IPv6 addresses.
+func (s *ServiceInfo) NamedEndpoints(name string) []Endpoint {
+	var ret []Endpoint
+	for _, e := range s.Endpoints {
+		if e.Name == name {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// EndpointAddresses returns the addresses of all endpoints with the given
+// name. If name is empty, only Address is returned.
+func (s *ServiceInfo) EndpointAddresses(name string) []string {
+	if name == "" {
+		return []string{s.Address}
+	}
+	var ret []string
+	for _, e := range s.NamedEndpoints(name) {
+		ret = append(ret, e.Address())
+	}
+	return ret
+}
+
+// EndpointAddress returns the address of the first endpoint with the given
+// name. If name is empty, Address is returned.
+func (s *ServiceInfo) EndpointAddress(name string) (string, bool) {
+	if name == "" {
+		return s.Address, true
+	}
+	if e := s.Endpoint(name); e != nil {
+		return e.Address(), true
+	}
+	return "", false
+}
+
+// EndpointPicker returns a Picker choosing among instances having an endpoint
+// with the given name using next, which is WeightedPicker if nil.
+func EndpointPicker(name string, next Picker) Picker {
+	return filterPicker(func(info *ServiceInfo) bool {
+		return info.Endpoint(name) != nil
+	}, next)
+}
+
+func endpointsEqual(left, right []Endpoint) bool {
+	if len(left) != len(right) {
+		return false
+	}
+	for i := range left {
+		if left[i] != right[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func endpointsProto(endpoints []Endpoint) []*dproto.Endpoint {
+	var ret []*dproto.Endpoint
+	for _, e := range endpoints {
+		ret = append(ret, &dproto.Endpoint{Name: e.Name, Scheme: e.Scheme, Host: e.Host, Port: uint32(e.Port)})
+	}
+	return ret
+}
+
+func endpointsFromProto(endpoints []*dproto.Endpoint) []Endpoint {
+	var ret []Endpoint
+	for _, e := range endpoints {
+		if e.Port > 0xffff {
+			continue
+		}
+		ret = append(ret, Endpoint{Name: e.Name, Scheme: e.Scheme, Host: e.Host, Port: uint16(e.Port)})
+	}
+	return ret
+}
@@ -0,0 +1,298 @@
+// Package envoy provides an Envoy Endpoint Discovery Service (EDS) control
+// plane fed by a service discovery agent.
+//
+// Every service is exposed as a ClusterLoadAssignment named after the
+// service. Services requested by Envoy are watched automatically, so an EDS
+// cluster only has to use the service name as its service_name.
+package envoy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	server "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/hatobito-io/discovery"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// DefaultLocality maps instance locality to Envoy locality.
+func DefaultLocality(info *discovery.ServiceInfo) *core.Locality {
+	return &core.Locality{
+		Region:  info.Locality.Region,
+		Zone:    info.Locality.Zone,
+		SubZone: info.Locality.Subzone,
+	}
+}
+
+// DefaultWeight maps the weight of an instance to Envoy load balancing weight.
+// Envoy requires positive weights, so instances with weight 0 get weight 1;
+// they are reported as draining.
+func DefaultWeight(info *discovery.ServiceInfo) uint32 {
+	if info.Weight == 0 {
+		return 1
+	}
+	return info.Weight
+}
+
+// allNodes makes every Envoy node share the same snapshot.
+type allNodes struct{}
+
+func (allNodes) ID(*core.Node) string {
+	return ""
+}
+
+// Server is an EDS control plane.
+type Server struct {
+	// Locality maps an instance to Envoy locality. DefaultLocality is used
+	// by NewServer.
+	Locality func(*discovery.ServiceInfo) *core.Locality
+	// Weight maps an instance to Envoy load balancing weight. DefaultWeight
+	// is used by NewServer.
+	Weight func(*discovery.ServiceInfo) uint32
+	// Endpoint is the name of the instance endpoint exposed to Envoy, see
+	// discovery.ServiceInfo.Endpoints. Instances without it are left out,
+	// instances with several endpoints with the name are exposed on all of
+	// them. If empty, the instance Address is used. Addresses must have IP
+	// hosts, others are left out.
+	Endpoint string
+
+	agent    *discovery.Agent
+	cache    cache.SnapshotCache
+	xds      server.Server
+	mu       sync.Mutex
+	services map[string]bool
+	version  uint64
+	changes  chan string
+}
+
+// NewServer creates a Server serving endpoints of the given services and of
+// any other service requested by Envoy. Patterns and names the agent can not
+// watch are ignored. The Server follows changes reported by the agent until
+// ctx is done.
+func NewServer(ctx context.Context, agent *discovery.Agent, services ...string) *Server {
+	s := &Server{
+		Locality: DefaultLocality,
+		Weight:   DefaultWeight,
+		agent:    agent,
+		cache:    cache.NewSnapshotCache(false, allNodes{}, nil),
+		services: make(map[string]bool),
+		changes:  make(chan string, 100),
+	}
+	s.xds = server.NewServer(ctx, s.cache, server.CallbackFuncs{
+		StreamRequestFunc: func(_ int64, req *discoverygrpc.DiscoveryRequest) error {
+			if req.TypeUrl == resource.EndpointType {
+				s.watch(req.ResourceNames...)
+			}
+			return nil
+		},
+		FetchRequestFunc: func(_ context.Context, req *discoverygrpc.DiscoveryRequest) error {
+			if req.TypeUrl == resource.EndpointType {
+				s.watch(req.ResourceNames...)
+			}
+			return nil
+		},
+	})
+	agent.Notify(s.changes)
+	s.watch(services...)
+	s.update()
+	go s.run(ctx)
+	return s
+}
+
+// Register registers the EDS and ADS services in grpcServer.
+func (s *Server) Register(grpcServer *grpc.Server) {
+	endpointservice.RegisterEndpointDiscoveryServiceServer(grpcServer, s.xds)
+	discoverygrpc.RegisterAggregatedDiscoveryServiceServer(grpcServer, s.xds)
+}
+
+func (s *Server) run(ctx context.Context) {
+	defer s.agent.StopNotify(s.changes)
+	for {
+		select {
+		case name := <-s.changes:
+			s.mu.Lock()
+			served := s.services[name]
+			s.mu.Unlock()
+			if served {
+				s.update()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watch starts serving the services. Names the agent can not watch, and
+// patterns, which do not name a single cluster, are left out.
+func (s *Server) watch(names ...string) {
+	var candidates []string
+	s.mu.Lock()
+	for _, name := range names {
+		if !s.services[name] && !discovery.IsPattern(name) {
+			candidates = append(candidates, name)
+		}
+	}
+	s.mu.Unlock()
+	var watched []string
+	for _, name := range candidates {
+		if err := s.agent.Watch(name); err == nil {
+			watched = append(watched, name)
+		}
+	}
+	if len(watched) == 0 {
+		return
+	}
+	s.mu.Lock()
+	for _, name := range watched {
+		s.services[name] = true
+	}
+	s.mu.Unlock()
+	s.update()
+}
+
+// update publishes a new snapshot with endpoints of all served services.
+func (s *Server) update() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var endpoints []types.Resource
+	for name := range s.services {
+		endpoints = append(endpoints, s.loadAssignment(name))
+	}
+	s.version++
+	snapshot := cache.NewSnapshot(strconv.FormatUint(s.version, 10), endpoints, nil, nil, nil, nil, nil)
+	s.cache.SetSnapshot("", snapshot)
+}
+
+// lbHost is an address of an instance exposed to Envoy. shares is the number
+// of addresses of the instance.
+type lbHost struct {
+	info   *discovery.ServiceInfo
+	host   string
+	port   uint32
+	shares uint32
+}
+
+// hosts returns the addresses of instances of the service which can be exposed
+// to Envoy. An instance with several endpoints with the name, e.g. IPv4 and
+// IPv6 ones, is exposed on all of them. Envoy only accepts IP addresses for
+// static endpoints and rejects the whole snapshot otherwise, so addresses with
+// host names are left out.
+func (s *Server) hosts(name string) []lbHost {
+	var ret []lbHost
+	for _, info := range s.agent.Discover(name, false) {
+		var addresses []lbHost
+		for _, address := range info.EndpointAddresses(s.Endpoint) {
+			host, portString, err := net.SplitHostPort(address)
+			if err != nil {
+				continue
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				continue
+			}
+			port, err := strconv.ParseUint(portString, 10, 16)
+			if err != nil {
+				continue
+			}
+			addresses = append(addresses, lbHost{info: info, host: ip.String(), port: uint32(port)})
+		}
+		for _, h := range addresses {
+			h.shares = uint32(len(addresses))
+			ret = append(ret, h)
+		}
+	}
+	return ret
+}
+
+func (s *Server) loadAssignment(name string) *endpoint.ClusterLoadAssignment {
+	hosts := s.hosts(name)
+	priorities := envoyPriorities(hosts)
+	byLocality := make(map[string]*endpoint.LocalityLbEndpoints)
+	for _, h := range hosts {
+		info := h.info
+		locality := s.Locality(info)
+		priority := priorities[info.Priority]
+		key := fmt.Sprintf("%010d/%s/%s/%s", priority, locality.Region, locality.Zone, locality.SubZone)
+		group := byLocality[key]
+		if group == nil {
+			group = &endpoint.LocalityLbEndpoints{
+				Locality:            locality,
+				LoadBalancingWeight: wrapperspb.UInt32(0),
+				Priority:            priority,
+			}
+			byLocality[key] = group
+		}
+		// The weight of an instance is split among its addresses.
+		weight := s.Weight(info) / h.shares
+		if weight == 0 {
+			weight = 1
+		}
+		group.LoadBalancingWeight.Value += weight
+		group.LbEndpoints = append(group.LbEndpoints, &endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{
+					Address: &core.Address{
+						Address: &core.Address_SocketAddress{
+							SocketAddress: &core.SocketAddress{
+								Address:       h.host,
+								PortSpecifier: &core.SocketAddress_PortValue{PortValue: h.port},
+							},
+						},
+					},
+				},
+			},
+			HealthStatus:        healthStatus(info),
+			LoadBalancingWeight: wrapperspb.UInt32(weight),
+		})
+	}
+	keys := make([]string, 0, len(byLocality))
+	for key := range byLocality {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	assignment := &endpoint.ClusterLoadAssignment{ClusterName: name}
+	for _, key := range keys {
+		assignment.Endpoints = append(assignment.Endpoints, byLocality[key])
+	}
+	return assignment
+}
+
+// healthStatus reports drained instances, which have weight 0, as draining, so
+// that Envoy does not send them new requests.
+func healthStatus(info *discovery.ServiceInfo) core.HealthStatus {
+	if info.Weight == 0 {
+		return core.HealthStatus_DRAINING
+	}
+	return core.HealthStatus_HEALTHY
+}
+
+// envoyPriorities maps priorities of the hosts to Envoy priorities, which must
+// start at 0 and have no gaps.
+func envoyPriorities(hosts []lbHost) map[uint32]uint32 {
+	var values []uint32
+	seen := make(map[uint32]bool)
+	for _, h := range hosts {
+		if !seen[h.info.Priority] {
+			seen[h.info.Priority] = true
+			values = append(values, h.info.Priority)
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	ret := make(map[uint32]uint32, len(values))
+	for i, value := range values {
+		ret[value] = uint32(i)
+	}
+	return ret
+}
@@ -0,0 +1,77 @@
+package discovery
+
+import "context"
+
+// filterAllows reports whether an instance should be kept according to the
+// filters set by WatchVersion or WatchSelector for the names and patterns
+// matching its service. Must be called with the lock held.
+func (a *Agent) filterAllows(info *ServiceInfo) bool {
+	filtered := false
+	for pattern := range a.watched {
+		if !MatchName(pattern, info.Name) {
+			continue
+		}
+		filters := a.filters[pattern]
+		if len(filters) == 0 {
+			return true
+		}
+		filtered = true
+		for _, filter := range filters {
+			if filter(info) {
+				return true
+			}
+		}
+	}
+	return !filtered
+}
+
+// watchFiltered watches the service keeping only instances accepted by any of
+// its filters. If the service is already watched without filters, nothing
+// changes.
+func (a *Agent) watchFiltered(serviceName string, filter func(*ServiceInfo) bool) error {
+	if err := validPattern(serviceName); err != nil {
+		return err
+	}
+	a.lock()
+	defer a.unlock()
+	if a.watched[serviceName] && len(a.filters[serviceName]) == 0 {
+		return nil
+	}
+	a.filters[serviceName] = append(a.filters[serviceName], filter)
+	a.watch(context.Background(), serviceName)
+	item := a.knownServices.first
+	for item != nil {
+		next := item.next
+		if MatchName(serviceName, item.Name) && !a.filterAllows(item) {
+			a.knownServices.remove(item)
+			a.changed(item.Name)
+		}
+		item = next
+	}
+	return nil
+}
+
+// filterPicker returns a Picker choosing among instances accepted by filter
+// using next, which is WeightedPicker if nil.
+func filterPicker(filter func(*ServiceInfo) bool, next Picker) Picker {
+	if next == nil {
+		next = WeightedPicker()
+	}
+	return PickerFunc(func(instances []*ServiceInfo) *ServiceInfo {
+		candidates := filterInstances(instances, filter)
+		if len(candidates) == 0 {
+			return nil
+		}
+		return next.Pick(candidates)
+	})
+}
+
+func filterInstances(instances []*ServiceInfo, filter func(*ServiceInfo) bool) []*ServiceInfo {
+	var ret []*ServiceInfo
+	for _, item := range instances {
+		if filter(item) {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
@@ -3,10 +3,18 @@ module github.com/hatobito-io/discovery
 go 1.14
 
 require (
-	github.com/golang/protobuf v1.4.2
+	github.com/Masterminds/semver/v3 v3.1.1
+	github.com/envoyproxy/go-control-plane v0.9.9
+	github.com/golang/protobuf v1.4.3
+	github.com/miekg/dns v1.1.31
 	github.com/nats-io/nats-server/v2 v2.1.7
-	github.com/nats-io/nats.go v1.10.0
+	github.com/nats-io/nats.go v1.11.0
+	github.com/nats-io/nkeys v0.3.0
 	github.com/onsi/ginkgo v1.14.0
 	github.com/onsi/gomega v1.10.1
+	github.com/prometheus/client_golang v1.7.1
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+	google.golang.org/grpc v1.36.0
 	google.golang.org/protobuf v1.25.0
 )
@@ -1,47 +1,73 @@
 package discovery
 
 import (
+	"context"
+	"sync/atomic"
 	"time"
 
 	dproto "github.com/hatobito-io/discovery/proto"
 	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
 )
 
 func (a *Agent) handleMessage(msg *nats.Msg) {
-	decoded, clientID, myself := a.parseNatsMessage(msg)
-	if decoded == nil {
+	decoded, clientID, identity, namespace, myself := a.parseNatsMessage(msg)
+	if decoded != nil && a.tap != nil {
+		a.tap(&Message{
+			Subject:   msg.Subject,
+			Type:      messageType(decoded),
+			ClientID:  clientID,
+			Identity:  identity,
+			Namespace: namespace,
+			Body:      decoded,
+		})
+	}
+	if decoded == nil || myself {
+		return
+	}
+	a.countReceived(messageType(decoded))
+	if !a.checkOwner(clientID, identity) {
 		return
 	}
+	if !a.checkIncarnation(clientID, decoded) {
+		return
+	}
+	ctx, span := a.startHandlerSpan(msg, decoded, clientID)
+	defer span.End()
 	switch decoded := decoded.(type) {
 	case *dproto.ServiceInterest:
-		if !myself {
-			a.handleInterestMessage(decoded, clientID)
-		}
+		a.handleInterestMessage(ctx, decoded, clientID)
 	case *dproto.ServicesList:
-		if !myself {
-			a.handleServiceListMessage(decoded, clientID)
-		}
+		a.handleServiceListMessage(decoded, clientID, identity, namespace)
 	case *dproto.AgentStopped:
-		if !myself {
-			a.handleStopMessage(clientID)
-		}
+		a.handleStopMessage(clientID)
+	case *dproto.AgentInfo:
+		a.handleAgentInfoMessage(decoded, clientID, namespace)
+	case *dproto.AgentInfoRequest:
+		a.handleAgentInfoRequest()
 	}
 }
 
 func (a *Agent) handleStopMessage(clientID string) {
+	atomic.AddUint64(&a.stats.stopMessages, 1)
+	a.log.Debug("discovery: agent stopped", "clientID", clientID)
 	a.lock()
 	defer a.unlock()
+	delete(a.agents, clientID)
 	item := a.knownServices.first
 	for item != nil {
 		next := item.next
 		if item.updatedBy == clientID {
 			a.knownServices.remove(item)
+			a.changed(item.Name)
+			a.log.Info("discovery: service instance left",
+				"service", item.Name, "address", item.Address, "clientID", clientID)
 		}
 		item = next
 	}
 }
 
-func (a *Agent) handleServiceListMessage(msg *dproto.ServicesList, clientID string) {
+func (a *Agent) handleServiceListMessage(msg *dproto.ServicesList, clientID, identity, namespace string) {
 	now := time.Now()
 	deadline := now.Add(DefaultUpdateInterval + DefaultUpdateInterval/10)
 	if len(msg.Services) < 1 {
@@ -49,48 +75,103 @@ func (a *Agent) handleServiceListMessage(msg *dproto.ServicesList, clientID stri
 	}
 	a.lock()
 	defer a.unlock()
+	if info := a.agents[clientID]; info != nil {
+		info.LastSeen = now
+	}
 	for _, svc := range msg.Services {
 		search := &ServiceInfo{
 			Address:   svc.Address,
 			Name:      svc.Name,
+			Namespace: namespace,
+			Metadata:  svc.Metadata,
+			Locality:  localityFromProto(svc.Locality),
+			Weight:    DefaultWeight,
+			Priority:  svc.Priority,
+			Load:      svc.Load,
+			Version:   svc.Version,
+			Endpoints: endpointsFromProto(svc.Endpoints),
 			updatedBy: clientID,
+			FirstSeen: now,
 			UpdatedAt: now,
 			GoodUntil: deadline,
 		}
+		if svc.Weight != nil {
+			search.Weight = *svc.Weight
+		}
+		if !a.filterAllows(search) {
+			continue
+		}
+		if !a.authorized(identity, search) {
+			continue
+		}
 		if item := a.knownServices.find(search); item != nil {
 			item.updatedBy = clientID
 			item.UpdatedAt = now
 			item.GoodUntil = deadline
+			if item.update(search) {
+				a.changed(item.Name)
+			}
 		} else {
 			a.knownServices.insert(search)
+			a.changed(search.Name)
+			a.log.Info("discovery: service instance joined",
+				"service", search.Name, "address", search.Address, "clientID", clientID)
 		}
 	}
 
 }
 
-func (a *Agent) handleInterestMessage(msg *dproto.ServiceInterest, clientID string) {
+func (a *Agent) handleInterestMessage(ctx context.Context, msg *dproto.ServiceInterest, clientID string) {
 	if len(msg.ServiceName) < 1 {
 		return
 	}
 	a.lock()
 	defer a.unlock()
 	item := a.providedServices.first
-	reply := &dproto.ServicesList{}
+	reply := &dproto.ServicesList{Incarnation: a.incarnation}
 	for item != nil {
-		if contains(msg.ServiceName, item.Name) {
-			s := &dproto.ServiceInfoProto{
-				Address:  item.Address,
-				ClientId: a.clientID,
-				Name:     item.Name,
-			}
-			reply.Services = append(reply.Services, s)
+		if matchAny(msg.ServiceName, item.Name) {
+			reply.Services = append(reply.Services, a.infoProto(item))
 		}
 		item = item.next
 	}
 	if len(reply.Services) > 0 {
 		a.send <- &msgWrapper{
+			ctx:     ctx,
 			subject: a.serviceListSubject(),
 			msg:     reply,
 		}
 	}
 }
+
+func messageType(msg interface{}) string {
+	switch msg.(type) {
+	case *dproto.ServiceInterest:
+		return MessageInterest
+	case *dproto.ServicesList:
+		return MessageServiceList
+	case *dproto.AgentStopped:
+		return MessageStop
+	case *dproto.AgentInfo:
+		return MessageAgentInfo
+	case *dproto.AgentInfoRequest:
+		return MessageAgentInfoRequest
+	}
+	return ""
+}
+
+// Message is a decoded protocol message received by the Agent.
+type Message struct {
+	Subject string
+	// Type is one of MessageInterest, MessageServiceList, MessageStop,
+	// MessageAgentInfo or MessageAgentInfoRequest.
+	Type     string
+	ClientID string
+	// Identity is the public key the message was signed with, if the Agent
+	// verifies signatures.
+	Identity string
+	// Namespace is the namespace the message was sent to.
+	Namespace string
+	// Body is one of the message types defined in the proto subpackage.
+	Body proto.Message
+}
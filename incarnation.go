@@ -0,0 +1,93 @@
+package discovery
+
+import (
+	"errors"
+	"strings"
+
+	dproto "github.com/hatobito-io/discovery/proto"
+)
+
+// validAgentID checks that id can be used as a single NATS subject token.
+func validAgentID(id string) error {
+	if id == "" {
+		return errors.New("Empty agent ID")
+	}
+	if strings.ContainsAny(id, ".*> \t\r\n") {
+		return errors.New("Agent ID " + id + " is not a valid NATS subject token")
+	}
+	return nil
+}
+
+type incarnated interface {
+	GetIncarnation() uint64
+}
+
+var (
+	_ incarnated = (*dproto.ServicesList)(nil)
+	_ incarnated = (*dproto.ServiceInterest)(nil)
+	_ incarnated = (*dproto.AgentStopped)(nil)
+	_ incarnated = (*dproto.AgentInfo)(nil)
+)
+
+// checkIncarnation tracks incarnations of other agents. A message from a newer
+// incarnation of a known agent makes the Agent forget everything announced by
+// the previous incarnation. Messages from older incarnations are stale and
+// checkIncarnation returns false for them. Messages without an incarnation are
+// always accepted.
+func (a *Agent) checkIncarnation(clientID string, msg interface{}) bool {
+	m, ok := msg.(incarnated)
+	if !ok || m.GetIncarnation() == 0 {
+		return true
+	}
+	incarnation := m.GetIncarnation()
+	a.lock()
+	defer a.unlock()
+	known := a.incarnations[clientID]
+	if incarnation < known {
+		a.log.Debug("discovery: ignoring message from previous incarnation",
+			"clientID", clientID, "incarnation", incarnation, "current", known)
+		return false
+	}
+	if incarnation > known {
+		if known != 0 {
+			a.log.Info("discovery: agent restarted", "clientID", clientID)
+			a.forgetAgent(clientID)
+		}
+		a.incarnations[clientID] = incarnation
+	}
+	return true
+}
+
+// forgetAgent removes everything announced by the agent. Must be called with
+// the lock held.
+func (a *Agent) forgetAgent(clientID string) {
+	item := a.knownServices.first
+	for item != nil {
+		next := item.next
+		if item.updatedBy == clientID {
+			a.knownServices.remove(item)
+			a.changed(item.Name)
+		}
+		item = next
+	}
+	delete(a.agents, clientID)
+}
+
+// expireIncarnations forgets incarnations and owners of agents which are no
+// longer known. Must be called with the lock held.
+func (a *Agent) expireIncarnations() {
+	active := make(map[string]bool)
+	for item := a.knownServices.first; item != nil; item = item.next {
+		active[item.updatedBy] = true
+	}
+	for clientID := range a.incarnations {
+		if !active[clientID] && a.agents[clientID] == nil {
+			delete(a.incarnations, clientID)
+		}
+	}
+	for clientID := range a.owners {
+		if !active[clientID] && a.agents[clientID] == nil && a.incarnations[clientID] == 0 {
+			delete(a.owners, clientID)
+		}
+	}
+}
@@ -2,12 +2,45 @@ package discovery
 
 import (
 	"time"
+
+	dproto "github.com/hatobito-io/discovery/proto"
+	"google.golang.org/protobuf/proto"
 )
 
 // ServiceInfo provides information about single service
 type ServiceInfo struct {
-	Name      string
-	Address   string
+	Name string
+	// Address identifies the instance among the instances of the service.
+	// It is usually its main host:port. If an instance is registered with
+	// endpoints but without address, the address of the first endpoint is
+	// used.
+	Address string
+	// Endpoints are the addresses the instance can be reached on, see
+	// Endpoint.
+	Endpoints []Endpoint
+	// Namespace is the namespace of the agent which announced the instance.
+	Namespace string
+	// Metadata holds arbitrary key/value pairs describing the instance.
+	Metadata map[string]string
+	// Version is the semantic version of the service provided by the
+	// instance, e.g. "2.1.0". It is optional.
+	Version string
+	// Locality tells where the instance runs.
+	Locality Locality
+	// Weight is the share of traffic the instance receives from weighted
+	// pickers relative to other instances, see WeightedPicker.
+	Weight uint32
+	// Drained makes Register use weight 0, which drains the instance, see
+	// SetWeight. Without it, Register treats weight 0 as no weight. It is
+	// not set on discovered instances.
+	Drained bool
+	// Priority is the failover tier of the instance. Instances with the
+	// lowest priority value are used, others are standby.
+	Priority uint32
+	// Load is the last load reported by the instance, see SetLoad.
+	Load float64
+	// FirstSeen is the time the Agent learned about the instance.
+	FirstSeen time.Time
 	UpdatedAt time.Time
 	GoodUntil time.Time
 	updatedBy string
@@ -15,9 +48,60 @@ type ServiceInfo struct {
 	prev      *ServiceInfo
 }
 
+// AgentID returns the client ID of the agent which announced the service
+// instance. It is empty for instances registered locally.
+func (s *ServiceInfo) AgentID() string {
+	return s.updatedBy
+}
+
 func (left *ServiceInfo) equals(right *ServiceInfo) bool {
 	return left.Name == right.Name &&
-		left.Address == right.Address
+		left.Address == right.Address &&
+		left.Namespace == right.Namespace
+}
+
+func (a *Agent) infoProto(info *ServiceInfo) *dproto.ServiceInfoProto {
+	return &dproto.ServiceInfoProto{
+		Address:   info.Address,
+		ClientId:  a.clientID,
+		Name:      info.Name,
+		Metadata:  info.Metadata,
+		Locality:  info.Locality.proto(),
+		Weight:    proto.Uint32(info.Weight),
+		Priority:  info.Priority,
+		Load:      info.Load,
+		Version:   info.Version,
+		Endpoints: endpointsProto(info.Endpoints),
+	}
+}
+
+// update copies announced attributes of the instance and reports whether any
+// of them changed. Load is not considered a change, as it is expected to
+// change with every update.
+func (s *ServiceInfo) update(from *ServiceInfo) bool {
+	changed := !stringMapsEqual(s.Metadata, from.Metadata) || s.Locality != from.Locality ||
+		s.Weight != from.Weight || s.Priority != from.Priority || s.Version != from.Version ||
+		!endpointsEqual(s.Endpoints, from.Endpoints)
+	s.Metadata = from.Metadata
+	s.Locality = from.Locality
+	s.Weight = from.Weight
+	s.Priority = from.Priority
+	s.Load = from.Load
+	s.Version = from.Version
+	s.Endpoints = from.Endpoints
+	return changed
+}
+
+func stringMapsEqual(left, right map[string]string) bool {
+	if len(left) != len(right) {
+		return false
+	}
+	for k, v := range left {
+		if r, ok := right[k]; !ok || r != v {
+			return false
+		}
+	}
+	return true
 }
 
 type infoList struct {
@@ -54,12 +138,12 @@ func (l *infoList) remove(item *ServiceInfo) {
 	if item.prev != nil {
 		item.prev.next = item.next
 	} else {
-		l.first = item.prev
+		l.first = item.next
 	}
 	if item.next != nil {
 		item.next.prev = item.prev
 	} else {
-		l.last = item
+		l.last = item.prev
 	}
 	l.size--
 }
@@ -83,4 +167,5 @@ func (l *infoList) clear() {
 	}
 	l.first = nil
 	l.last = nil
+	l.size = 0
 }
@@ -0,0 +1,75 @@
+// Package cmdutil contains helpers shared by the commands.
+package cmdutil
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/hatobito-io/discovery"
+	"github.com/nats-io/nats.go"
+)
+
+// Flags holds the command line flags common to all commands.
+type Flags struct {
+	URL        string
+	Prefix     string
+	Namespace  string
+	Namespaces string
+}
+
+// Register registers the flags in fs.
+func (f *Flags) Register(fs *flag.FlagSet) {
+	fs.StringVar(&f.URL, "nats", nats.DefaultURL, "NATS server URL")
+	fs.StringVar(&f.Prefix, "prefix", discovery.DefaultSubjectPrefix, "discovery subject prefix")
+	fs.StringVar(&f.Namespace, "namespace", discovery.DefaultNamespace, "namespace of the agent")
+	fs.StringVar(&f.Namespaces, "discover-namespaces", "", "comma separated list of other namespaces to discover services in")
+}
+
+// Connect connects to NATS and creates an Agent which is notified about
+// connection state changes. The Agent is not started.
+func (f *Flags) Connect(opts ...discovery.Option) (*discovery.Agent, *nats.Conn, error) {
+	var agent *discovery.Agent
+	ready := make(chan struct{})
+	stateChanged := func(conn *nats.Conn) {
+		<-ready
+		if agent != nil {
+			agent.ConnStateHandler(conn)
+		}
+	}
+	conn, err := nats.Connect(f.URL,
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(conn *nats.Conn, _ error) { stateChanged(conn) }),
+		nats.ReconnectHandler(stateChanged),
+		nats.ClosedHandler(stateChanged),
+	)
+	if err != nil {
+		close(ready)
+		return nil, nil, err
+	}
+	common := []discovery.Option{discovery.SubjectPrefix(f.Prefix)}
+	if f.Namespace != discovery.DefaultNamespace {
+		common = append(common, discovery.Namespace(f.Namespace))
+	}
+	if f.Namespaces != "" {
+		common = append(common, discovery.DiscoverableNamespaces(strings.Split(f.Namespaces, ",")...))
+	}
+	opts = append(common, opts...)
+	agent, err = discovery.NewAgent(conn, opts...)
+	close(ready)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return agent, conn, nil
+}
+
+// Signal returns a channel receiving the first SIGINT or SIGTERM received by
+// the process.
+func Signal() <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	return ch
+}
@@ -0,0 +1,57 @@
+package discovery
+
+import (
+	"math"
+	"math/rand"
+)
+
+// SetLoad sets the current load of a registered instance. The load is sent to
+// other agents with the periodic updates, so it reaches them within the update
+// interval. Any measure where lower values mean less loaded can be used, e.g.
+// requests in flight, CPU usage or queue depth, as long as all instances of a
+// service use the same one.
+func (a *Agent) SetLoad(info *ServiceInfo, load float64) error {
+	key := a.providedKey(info)
+	a.lock()
+	defer a.unlock()
+	item := a.findProvided(key)
+	if item == nil {
+		return errNotRegistered(info)
+	}
+	item.Load = load
+	return nil
+}
+
+// LeastLoadedPicker returns a Picker preferring less loaded instances. It
+// takes two random instances and chooses the one with lower load relative to
+// its weight, which avoids sending all traffic to the same instance between
+// load updates. Like WeightedPicker, it only considers instances with the
+// lowest priority value.
+func LeastLoadedPicker() Picker {
+	return PickerFunc(func(instances []*ServiceInfo) *ServiceInfo {
+		instances = bestPriority(instances)
+		if len(instances) == 0 {
+			return nil
+		}
+		if len(instances) == 1 {
+			return instances[0]
+		}
+		i := rand.Intn(len(instances))
+		j := rand.Intn(len(instances) - 1)
+		if j >= i {
+			j++
+		}
+		first, second := instances[i], instances[j]
+		if relativeLoad(second) < relativeLoad(first) {
+			return second
+		}
+		return first
+	})
+}
+
+func relativeLoad(info *ServiceInfo) float64 {
+	if info.Weight == 0 {
+		return math.Inf(1)
+	}
+	return info.Load / float64(info.Weight)
+}
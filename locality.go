@@ -0,0 +1,86 @@
+package discovery
+
+import (
+	dproto "github.com/hatobito-io/discovery/proto"
+)
+
+// Locality describes where an agent or a service instance runs, e.g. cloud
+// region, availability zone and rack.
+type Locality struct {
+	Region  string
+	Zone    string
+	Subzone string
+}
+
+// IsZero reports whether the locality is not set.
+func (l Locality) IsZero() bool {
+	return l == Locality{}
+}
+
+// String returns the locality in the form region/zone/subzone.
+func (l Locality) String() string {
+	return l.Region + "/" + l.Zone + "/" + l.Subzone
+}
+
+// distance returns 0 for the same subzone, 1 for the same zone, 2 for the
+// same region and 3 otherwise.
+func (l Locality) distance(other Locality) int {
+	switch {
+	case l.Region != other.Region:
+		return 3
+	case l.Zone != other.Zone:
+		return 2
+	case l.Subzone != other.Subzone:
+		return 1
+	}
+	return 0
+}
+
+func (l Locality) proto() *dproto.Locality {
+	if l.IsZero() {
+		return nil
+	}
+	return &dproto.Locality{Region: l.Region, Zone: l.Zone, Subzone: l.Subzone}
+}
+
+func localityFromProto(msg *dproto.Locality) Locality {
+	return Locality{Region: msg.GetRegion(), Zone: msg.GetZone(), Subzone: msg.GetSubzone()}
+}
+
+// Locality returns the locality of the Agent, see AgentLocality.
+func (a *Agent) Locality() Locality {
+	return a.locality
+}
+
+// LocalityPicker returns a Picker preferring instances close to local. The
+// instances are ordered by distance from local: same subzone, same zone, same
+// region, anywhere else. The picker takes the closest of these tiers which
+// together have at least minInstances instances and chooses among them using
+// next, which is WeightedPicker if nil. Since Agent.Pick skips ejected instances,
+// traffic spills over to farther tiers when close instances fail.
+func LocalityPicker(local Locality, minInstances int, next Picker) Picker {
+	if next == nil {
+		next = WeightedPicker()
+	}
+	return PickerFunc(func(instances []*ServiceInfo) *ServiceInfo {
+		var tiers [4][]*ServiceInfo
+		for _, item := range instances {
+			d := local.distance(item.Locality)
+			tiers[d] = append(tiers[d], item)
+		}
+		var candidates []*ServiceInfo
+		for _, tier := range tiers {
+			if len(tier) == 0 {
+				continue
+			}
+			candidates = append(candidates, tier...)
+			if len(candidates) >= minInstances {
+				break
+			}
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+		return next.Pick(candidates)
+	})
+}
@@ -0,0 +1,99 @@
+package discovery
+
+import (
+	"errors"
+	"strings"
+)
+
+// DefaultNamespace is the namespace of agents created without the Namespace
+// option. Agents in the default namespace use the same subjects as agents
+// which do not support namespaces.
+const DefaultNamespace = ""
+
+// namespaceToken separates the subject prefix from the namespace in subjects of
+// agents in other than the default namespace:
+// <prefix>.ns.<namespace>.<message type>.<client ID>.
+const namespaceToken = "ns"
+
+// validNamespace checks that a namespace can be used as a single NATS subject
+// token.
+func validNamespace(namespace string) error {
+	if namespace == "" {
+		return errors.New("Empty namespace")
+	}
+	if strings.ContainsAny(namespace, ".*> \t\r\n") {
+		return errors.New("Namespace " + namespace + " is not a valid NATS subject token")
+	}
+	return nil
+}
+
+// namespacePrefix returns the subject prefix of messages in the namespace.
+func (a *Agent) namespacePrefix(namespace string) string {
+	if namespace == DefaultNamespace {
+		return a.subjectPrefix
+	}
+	return a.subjectPrefix + "." + namespaceToken + "." + namespace
+}
+
+// subscriptionSubjects returns the subjects of the namespaces visible to the
+// Agent: its own and the ones set with DiscoverableNamespaces.
+func (a *Agent) subscriptionSubjects() []string {
+	subjects := []string{a.namespacePrefix(a.namespace) + ".*.*"}
+	for _, namespace := range a.otherNamespaces() {
+		subjects = append(subjects, a.namespacePrefix(namespace)+".*.*")
+	}
+	return subjects
+}
+
+// otherNamespaces returns the discoverable namespaces except the Agent's own.
+func (a *Agent) otherNamespaces() []string {
+	var ret []string
+	for _, namespace := range a.namespaces {
+		if namespace != a.namespace {
+			ret = append(ret, namespace)
+		}
+	}
+	return ret
+}
+
+// splitSubject returns the namespace, message type and client ID of a subject
+// under the Agent's subject prefix.
+func (a *Agent) splitSubject(subject string) (namespace, messageType, clientID string, ok bool) {
+	parts := strings.Split(subject, ".")
+	if len(parts) < a.prefixParts+2 || strings.Join(parts[:a.prefixParts], ".") != a.subjectPrefix {
+		return "", "", "", false
+	}
+	parts = parts[a.prefixParts:]
+	if parts[0] == namespaceToken {
+		if len(parts) < 4 {
+			return "", "", "", false
+		}
+		namespace, parts = parts[1], parts[2:]
+	}
+	return namespace, parts[0], strings.Join(parts[1:], "."), true
+}
+
+// Namespace returns the namespace of the Agent.
+func (a *Agent) Namespace() string {
+	return a.namespace
+}
+
+// providedKey returns the key identifying a locally registered instance. Local
+// instances are always in the Agent's namespace, and their addresses are
+// normalized if addresses are validated. It must be called without the lock
+// held, as normalizing may detect the advertise IP.
+func (a *Agent) providedKey(info *ServiceInfo) *ServiceInfo {
+	key := &ServiceInfo{Name: info.Name, Address: info.Address, Namespace: a.namespace}
+	if a.addresses != nil {
+		if address, err := a.normalizeAddress(info.Address); err == nil {
+			key.Address = address
+		}
+	}
+	return key
+}
+
+// findProvided finds a locally registered instance by its key, see
+// providedKey. Must be called with the lock held.
+func (a *Agent) findProvided(key *ServiceInfo) *ServiceInfo {
+	return a.providedServices.find(key)
+}
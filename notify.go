@@ -0,0 +1,31 @@
+package discovery
+
+// Notify causes the Agent to send the name of a service to ch every time the
+// set of known or locally registered instances of the service changes, or an
+// attribute of one of them changes, such as its metadata, endpoints, weight or
+// priority. Load updates are not reported. The Agent does not block sending to
+// ch: the caller must ensure that ch has sufficient buffer space to keep up
+// with the expected change rate. A notification is dropped if ch is full.
+func (a *Agent) Notify(ch chan<- string) {
+	a.lock()
+	defer a.unlock()
+	a.notify[ch] = true
+}
+
+// StopNotify causes the Agent to stop sending notifications to ch.
+func (a *Agent) StopNotify(ch chan<- string) {
+	a.lock()
+	defer a.unlock()
+	delete(a.notify, ch)
+}
+
+// changed notifies the subscribers about a change of a service. Must be called
+// with the lock held.
+func (a *Agent) changed(serviceName string) {
+	for ch := range a.notify {
+		select {
+		case ch <- serviceName:
+		default:
+		}
+	}
+}
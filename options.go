@@ -1,6 +1,13 @@
 package discovery
 
-import "errors"
+import (
+	"errors"
+	"time"
+
+	"github.com/nats-io/nkeys"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
 
 // Option is used to provide options to NewAgent
 type Option func(*Agent) error
@@ -14,6 +21,239 @@ func SubjectPrefix(prefix string) func(*Agent) error {
 		if len(prefix) == 0 {
 			return errors.New("Empty topic prefix")
 		}
+		s.subjectPrefix = prefix
+		return nil
+	}
+}
+
+// SigningKey is an Option that makes the Agent sign every message it publishes
+// with the given nkey. All agents sharing the subject prefix must either sign
+// their messages or not.
+func SigningKey(key nkeys.KeyPair) Option {
+	return func(a *Agent) error {
+		if key == nil {
+			return errors.New("Nil signing key")
+		}
+		pub, err := key.PublicKey()
+		if err != nil {
+			return err
+		}
+		if _, err := key.Sign(nil); err != nil {
+			return err
+		}
+		a.signingKey = key
+		a.signingPub = pub
+		return nil
+	}
+}
+
+// TrustedKeys is an Option that makes the Agent verify signatures of received
+// messages. Messages which are not signed by one of the given public nkeys are
+// rejected and counted, see RejectedMessages. The key used with SigningKey is
+// always trusted. Replayed messages and messages signed outside of the
+// SignatureWindow are rejected as well.
+func TrustedKeys(keys ...string) Option {
+	return func(a *Agent) error {
+		if a.trustedKeys == nil {
+			a.trustedKeys = make(map[string]bool)
+		}
+		for _, key := range keys {
+			if !nkeys.IsValidPublicKey(key) {
+				return errors.New("Invalid public key " + key)
+			}
+			a.trustedKeys[key] = true
+		}
+		return nil
+	}
+}
+
+// SignatureWindow is an Option that sets how far the time a received message
+// was signed at may be from the current time, see DefaultSignatureWindow.
+// Signed messages outside of the window are rejected, so the window must
+// exceed clock differences between hosts plus message delivery time.
+func SignatureWindow(window time.Duration) Option {
+	return func(a *Agent) error {
+		if window <= 0 {
+			return errors.New("Signature window must be positive")
+		}
+		a.replay.window = window
+		return nil
+	}
+}
+
+// PublishPolicy is an Option that makes the Agent consult the given Policy for
+// every service announcement received from other agents. Unauthorized
+// announcements are dropped and counted, see UnauthorizedAnnouncements. The
+// policy relies on identities of signers, so TrustedKeys must be used as well.
+func PublishPolicy(policy Policy) Option {
+	return func(a *Agent) error {
+		a.policy = policy
+		return nil
+	}
+}
+
+// UnauthorizedHandler is an Option that sets a function called for every
+// service announcement dropped by the PublishPolicy. The function is called
+// with the Agent's internal lock held and must not call Agent methods.
+func UnauthorizedHandler(handler func(identity string, info *ServiceInfo)) Option {
+	return func(a *Agent) error {
+		a.onUnauthorized = handler
+		return nil
+	}
+}
+
+// EncryptionKeys is an Option that makes the Agent encrypt payloads of the
+// messages it publishes with AES-GCM. Keys are identified by arbitrary IDs and
+// must be 16, 24 or 32 bytes long. Messages are encrypted with the key
+// identified by activeID, while messages encrypted with any of the keys are
+// accepted. To rotate keys without losing messages, first distribute the new
+// key to all agents, then make it active, then remove the old key, see
+// SetEncryptionKeys. All agents sharing the subject prefix must either use
+// encryption or not.
+func EncryptionKeys(activeID string, keys map[string][]byte) Option {
+	return func(a *Agent) error {
+		ring, err := newKeyring(activeID, keys)
+		if err != nil {
+			return err
+		}
+		a.keyring.Store(ring)
+		return nil
+	}
+}
+
+// Logging is an Option that sets the Logger used by the Agent. By default
+// nothing is logged.
+func Logging(logger Logger) Option {
+	return func(a *Agent) error {
+		if logger == nil {
+			return errors.New("Nil logger")
+		}
+		a.log = logger
+		return nil
+	}
+}
+
+// TracerProvider is an Option that sets the OpenTelemetry TracerProvider used
+// by the Agent. By default the global TracerProvider is used.
+func TracerProvider(provider trace.TracerProvider) Option {
+	return func(a *Agent) error {
+		a.tracerProvider = provider
+		return nil
+	}
+}
+
+// Propagator is an Option that sets the propagator used to pass trace context
+// between agents in NATS message headers. By default the global propagator is
+// used. Trace context is only propagated if the NATS server supports headers.
+func Propagator(propagator propagation.TextMapPropagator) Option {
+	return func(a *Agent) error {
+		a.textPropagator = propagator
+		return nil
+	}
+}
+
+// Tap is an Option that sets a function called for every decoded message
+// received by the Agent, including messages sent by the Agent itself. It is
+// meant for debugging tools. The function is called synchronously from the
+// NATS subscription handler and must not block.
+func Tap(fn func(*Message)) Option {
+	return func(a *Agent) error {
+		a.tap = fn
+		return nil
+	}
+}
+
+// Labels is an Option that sets arbitrary labels announced to other agents
+// along with the description of the Agent, see AgentInfo.
+func Labels(labels map[string]string) Option {
+	return func(a *Agent) error {
+		a.labels = make(map[string]string, len(labels))
+		for k, v := range labels {
+			a.labels[k] = v
+		}
+		return nil
+	}
+}
+
+// OutlierDetection is an Option that enables passive outlier detection based
+// on call results reported with ReportResult.
+func OutlierDetection(config OutlierConfig) Option {
+	return func(a *Agent) error {
+		a.outliers = newOutlierDetector(config)
+		return nil
+	}
+}
+
+// AddressValidation is an Option that makes Register validate addresses and
+// endpoints of instances and convert them to canonical form, so that typos
+// and hosts other agents can not reach do not get announced. Addresses must
+// have the form host:port or be URLs with a host. Other methods taking an
+// instance accept the address in any form Register accepts.
+func AddressValidation(config AddressConfig) Option {
+	return func(a *Agent) error {
+		a.addresses = &config
+		return nil
+	}
+}
+
+// AgentLocality is an Option that sets the locality of the Agent. It is
+// announced to other agents and used for local instances registered without
+// locality.
+func AgentLocality(locality Locality) Option {
+	return func(a *Agent) error {
+		a.locality = locality
+		return nil
+	}
+}
+
+// Namespace is an Option that puts the Agent in a namespace. Agents only see
+// services registered by agents in the same namespace, unless allowed with
+// DiscoverableNamespaces. Agents in different namespaces use different
+// subjects, so NATS permissions can be used to isolate them. The namespace
+// must be a valid NATS subject token. By default agents are in
+// DefaultNamespace.
+func Namespace(namespace string) Option {
+	return func(a *Agent) error {
+		if err := validNamespace(namespace); err != nil {
+			return err
+		}
+		a.namespace = namespace
+		return nil
+	}
+}
+
+// DiscoverableNamespaces is an Option that makes services registered in other
+// namespaces visible to the Agent. Instances from other namespaces are returned
+// by Discover along with the ones from the Agent's namespace; their Namespace
+// field tells them apart. DefaultNamespace may be listed as well. Duplicates
+// are ignored.
+func DiscoverableNamespaces(namespaces ...string) Option {
+	return func(a *Agent) error {
+		a.namespaces = nil
+		for _, namespace := range namespaces {
+			if namespace != DefaultNamespace {
+				if err := validNamespace(namespace); err != nil {
+					return err
+				}
+			}
+			if !contains(a.namespaces, namespace) {
+				a.namespaces = append(a.namespaces, namespace)
+			}
+		}
+		return nil
+	}
+}
+
+// AgentID is an Option that sets a stable ID of the Agent instead of a random
+// one. The ID must be a valid NATS subject token. When a process using a
+// stable ID restarts, other agents immediately replace everything announced by
+// the previous run. No two running agents may use the same ID.
+func AgentID(id string) Option {
+	return func(a *Agent) error {
+		if err := validAgentID(id); err != nil {
+			return err
+		}
+		a.clientID = id
 		return nil
 	}
 }
@@ -0,0 +1,152 @@
+package discovery
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OutlierConfig configures passive outlier detection, see OutlierDetection.
+// Zero fields are replaced with defaults.
+type OutlierConfig struct {
+	// ConsecutiveFailures is the number of failures in a row after which an
+	// instance is ejected. Default is 5.
+	ConsecutiveFailures int
+	// BaseEjectionTime is how long an instance is ejected for the first
+	// time. Every following ejection doubles the time. Default is 30
+	// seconds.
+	BaseEjectionTime time.Duration
+	// MaxEjectionTime limits the ejection time. An instance which was not
+	// ejected for this long starts over with BaseEjectionTime. Default is 5
+	// minutes.
+	MaxEjectionTime time.Duration
+	// SlowCallThreshold, if positive, makes successful calls which took
+	// longer count as failures.
+	SlowCallThreshold time.Duration
+}
+
+type outlierState struct {
+	failures     int
+	ejections    uint
+	ejectedUntil time.Time
+	lastReport   time.Time
+}
+
+// outlierDetector tracks results of calls to instances reported by the
+// application. It has its own lock, as results are reported for every call.
+type outlierDetector struct {
+	config OutlierConfig
+	mu     sync.Mutex
+	states map[instanceKey]*outlierState
+}
+
+type instanceKey struct {
+	name    string
+	address string
+}
+
+func newOutlierDetector(config OutlierConfig) *outlierDetector {
+	if config.ConsecutiveFailures <= 0 {
+		config.ConsecutiveFailures = 5
+	}
+	if config.BaseEjectionTime <= 0 {
+		config.BaseEjectionTime = 30 * time.Second
+	}
+	if config.MaxEjectionTime < config.BaseEjectionTime {
+		config.MaxEjectionTime = 5 * time.Minute
+		if config.MaxEjectionTime < config.BaseEjectionTime {
+			config.MaxEjectionTime = config.BaseEjectionTime
+		}
+	}
+	return &outlierDetector{config: config, states: make(map[instanceKey]*outlierState)}
+}
+
+// report records a call result and returns the ejection time if the instance
+// got ejected.
+func (d *outlierDetector) report(key instanceKey, success bool, latency time.Duration, now time.Time) time.Duration {
+	if success && d.config.SlowCallThreshold > 0 && latency > d.config.SlowCallThreshold {
+		success = false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state := d.states[key]
+	if state == nil {
+		if success {
+			return 0
+		}
+		state = &outlierState{}
+		d.states[key] = state
+	}
+	state.lastReport = now
+	if success {
+		state.failures = 0
+		return 0
+	}
+	if now.Before(state.ejectedUntil) {
+		return 0
+	}
+	state.failures++
+	if state.failures < d.config.ConsecutiveFailures {
+		return 0
+	}
+	if state.ejections > 0 && now.Sub(state.ejectedUntil) > d.config.MaxEjectionTime {
+		state.ejections = 0
+	}
+	ejectFor := d.config.MaxEjectionTime
+	if state.ejections < 32 {
+		if backoff := d.config.BaseEjectionTime << state.ejections; backoff > 0 && backoff < ejectFor {
+			ejectFor = backoff
+		}
+	}
+	state.ejections++
+	state.failures = 0
+	state.ejectedUntil = now.Add(ejectFor)
+	return ejectFor
+}
+
+// admitted returns the instances which are not ejected. If all of them are,
+// all are returned, as sending traffic to a failing instance is still better
+// than not sending it at all.
+func (d *outlierDetector) admitted(instances []*ServiceInfo, now time.Time) []*ServiceInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var ret []*ServiceInfo
+	for _, item := range instances {
+		state := d.states[instanceKey{item.Name, item.Address}]
+		if state == nil || !now.Before(state.ejectedUntil) {
+			ret = append(ret, item)
+		}
+	}
+	if len(ret) == 0 {
+		return instances
+	}
+	return ret
+}
+
+// prune forgets instances without reports for longer than MaxEjectionTime.
+func (d *outlierDetector) prune(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, state := range d.states {
+		if now.Sub(state.lastReport) > d.config.MaxEjectionTime && !now.Before(state.ejectedUntil) {
+			delete(d.states, key)
+		}
+	}
+}
+
+// ReportResult reports the result of a call to an instance returned by Pick
+// or Discover. If the Agent uses outlier detection, instances failing
+// repeatedly are ejected: Pick does not return them until the ejection time
+// passes. Results are only used by this Agent and are not shared with other
+// agents.
+func (a *Agent) ReportResult(info *ServiceInfo, success bool, latency time.Duration) {
+	if a.outliers == nil {
+		return
+	}
+	ejectFor := a.outliers.report(instanceKey{info.Name, info.Address}, success, latency, time.Now())
+	if ejectFor > 0 {
+		atomic.AddUint64(&a.stats.ejections, 1)
+		a.log.Warn("discovery: service instance ejected",
+			"service", info.Name, "address", info.Address, "duration", ejectFor)
+	}
+}
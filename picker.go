@@ -0,0 +1,83 @@
+package discovery
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Picker chooses one of the instances of a service. Pickers must be safe for
+// concurrent use.
+type Picker interface {
+	// Pick returns one of the instances, or nil if there are none or none
+	// is acceptable.
+	Pick(instances []*ServiceInfo) *ServiceInfo
+}
+
+// PickerFunc is an adapter allowing use of ordinary functions as Picker.
+type PickerFunc func(instances []*ServiceInfo) *ServiceInfo
+
+// Pick calls f(instances).
+func (f PickerFunc) Pick(instances []*ServiceInfo) *ServiceInfo {
+	return f(instances)
+}
+
+// RandomPicker returns a Picker choosing instances uniformly at random.
+func RandomPicker() Picker {
+	return PickerFunc(func(instances []*ServiceInfo) *ServiceInfo {
+		if len(instances) == 0 {
+			return nil
+		}
+		return instances[rand.Intn(len(instances))]
+	})
+}
+
+// RoundRobinPicker returns a Picker choosing instances in turn.
+func RoundRobinPicker() Picker {
+	var next uint64
+	return PickerFunc(func(instances []*ServiceInfo) *ServiceInfo {
+		if len(instances) == 0 {
+			return nil
+		}
+		n := atomic.AddUint64(&next, 1) - 1
+		return instances[n%uint64(len(instances))]
+	})
+}
+
+// Pick returns an instance of the service chosen by picker among known
+// instances, or nil if there are none. Instances with addresses listed in
+// exclude are not considered, nor are instances ejected by outlier detection,
+// unless all of them are. If picker is nil, WeightedPicker is used, so standby
+// instances only get traffic when no preferred ones are left.
+func (a *Agent) Pick(ctx context.Context, serviceName string, picker Picker, exclude ...string) *ServiceInfo {
+	_, span := a.tracer().Start(ctx, "discovery.Pick",
+		trace.WithAttributes(attrService.String(serviceName), attrClientID.String(a.clientID)))
+	defer span.End()
+	instances := a.discover(serviceName, false)
+	candidates := instances[:0]
+	for _, item := range instances {
+		if !contains(exclude, item.Address) {
+			candidates = append(candidates, item)
+		}
+	}
+	span.SetAttributes(attrInstances.Int(len(candidates)))
+	if len(candidates) == 0 {
+		return nil
+	}
+	if a.outliers != nil {
+		candidates = a.outliers.admitted(candidates, time.Now())
+	}
+	if picker == nil {
+		picker = defaultPicker
+	}
+	picked := picker.Pick(candidates)
+	if picked != nil {
+		span.SetAttributes(attrAddress.String(picked.Address))
+	}
+	return picked
+}
+
+var defaultPicker = WeightedPicker()
@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// Policy decides which agent identities may advertise which services. The
+// identity is the public nkey the announcement was signed with, so a Policy
+// requires the Agent to verify signatures (see TrustedKeys).
+type Policy interface {
+	Authorize(identity, serviceName string) bool
+}
+
+// PolicyFunc is an adapter allowing to use ordinary functions as a Policy.
+type PolicyFunc func(identity, serviceName string) bool
+
+// Authorize calls f(identity, serviceName).
+func (f PolicyFunc) Authorize(identity, serviceName string) bool {
+	return f(identity, serviceName)
+}
+
+type policyRule struct {
+	pattern    string
+	identities map[string]bool
+}
+
+// RulePolicy is a Policy built from a list of rules. Each rule restricts
+// service names matching a pattern to a set of identities. Patterns use NATS
+// subject wildcards: "*" matches a single token and ">" matches one or more
+// trailing tokens, so "payments.>" matches "payments.api" and
+// "payments.api.v2". A service name matching several rules is authorized if
+// any of them lists the identity. Service names not matching any rule are
+// authorized only if DefaultAllow is true.
+type RulePolicy struct {
+	DefaultAllow bool
+	rules        []policyRule
+}
+
+// Allow adds a rule authorizing given identities to advertise services with
+// names matching the pattern.
+func (p *RulePolicy) Allow(pattern string, identities ...string) *RulePolicy {
+	rule := policyRule{pattern: pattern, identities: make(map[string]bool)}
+	for _, identity := range identities {
+		rule.identities[identity] = true
+	}
+	p.rules = append(p.rules, rule)
+	return p
+}
+
+// Authorize implements Policy.
+func (p *RulePolicy) Authorize(identity, serviceName string) bool {
+	matched := false
+	for _, rule := range p.rules {
+		if !matchPattern(rule.pattern, serviceName) {
+			continue
+		}
+		if rule.identities[identity] {
+			return true
+		}
+		matched = true
+	}
+	return !matched && p.DefaultAllow
+}
+
+// matchPattern matches a dot separated name against a pattern which may
+// contain NATS subject wildcards.
+func matchPattern(pattern, name string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	nameTokens := strings.Split(name, ".")
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(nameTokens) > i
+		}
+		if i >= len(nameTokens) {
+			return false
+		}
+		if token != "*" && token != nameTokens[i] {
+			return false
+		}
+	}
+	return len(patternTokens) == len(nameTokens)
+}
+
+func (a *Agent) authorized(identity string, info *ServiceInfo) bool {
+	if a.policy == nil || a.policy.Authorize(identity, info.Name) {
+		return true
+	}
+	atomic.AddUint64(&a.stats.unauthorized, 1)
+	a.log.Warn("discovery: unauthorized service announcement",
+		"service", info.Name, "address", info.Address, "clientID", info.updatedBy, "identity", identity)
+	if a.onUnauthorized != nil {
+		a.onUnauthorized(identity, info)
+	}
+	return false
+}
+
+// checkOwner binds every client ID to the identity which sent the first
+// message with it, and rejects messages with the client ID sent by any other
+// identity. Otherwise any trusted identity could stop other agents or take
+// over their instances by publishing on their subjects. An agent restarting
+// with the same AgentID must use the same signing key until its previous run
+// is forgotten.
+func (a *Agent) checkOwner(clientID, identity string) bool {
+	if a.trustedKeys == nil {
+		return true
+	}
+	a.lock()
+	defer a.unlock()
+	owner, ok := a.owners[clientID]
+	if !ok {
+		a.owners[clientID] = identity
+		return true
+	}
+	if owner == identity {
+		return true
+	}
+	atomic.AddUint64(&a.stats.unauthorized, 1)
+	a.log.Warn("discovery: message from identity not owning the client ID",
+		"clientID", clientID, "identity", identity, "owner", owner)
+	return false
+}
+
+// UnauthorizedAnnouncements returns the number of service announcements
+// dropped because the Policy did not authorize them, and of messages dropped
+// because they were sent by an identity not owning their client ID.
+func (a *Agent) UnauthorizedAnnouncements() uint64 {
+	return atomic.LoadUint64(&a.stats.unauthorized)
+}
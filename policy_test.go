@@ -0,0 +1,100 @@
+package discovery
+
+import (
+	dproto "github.com/hatobito-io/discovery/proto"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RulePolicy", func() {
+	policy := (&RulePolicy{DefaultAllow: true}).
+		Allow("payments.>", "A").
+		Allow("payments.api", "B").
+		Allow("orders.*.v1", "C")
+
+	table.DescribeTable("authorizes identities by service name",
+		func(identity, serviceName string, authorized bool) {
+			Expect(policy.Authorize(identity, serviceName)).To(Equal(authorized))
+		},
+		table.Entry("\">\" matches one trailing token", "A", "payments.api", true),
+		table.Entry("\">\" matches several trailing tokens", "A", "payments.api.v2", true),
+		table.Entry("\">\" does not match the prefix alone", "B", "payments", true),
+		table.Entry("any matching rule authorizes", "B", "payments.api", true),
+		table.Entry("matching rules restrict other identities", "B", "payments.db", false),
+		table.Entry("\"*\" matches a single token", "C", "orders.eu.v1", true),
+		table.Entry("\"*\" does not match several tokens", "A", "orders.eu.west.v1", true),
+		table.Entry("\"*\" restricts matching names", "A", "orders.eu.v1", false),
+		table.Entry("names without rules follow DefaultAllow", "D", "inventory", true),
+	)
+
+	It("rejects names without rules unless DefaultAllow is set", func() {
+		strict := (&RulePolicy{}).Allow("payments.>", "A")
+		Expect(strict.Authorize("A", "payments.api")).To(BeTrue())
+		Expect(strict.Authorize("A", "inventory")).To(BeFalse())
+	})
+})
+
+var _ = Describe("Publish authorization", func() {
+	var (
+		agents   testAgents
+		owner    *Agent
+		impostor *Agent
+		other    *Agent
+		receiver *Agent
+	)
+
+	BeforeEach(func() {
+		owner = agents.new(AgentID("agent-1"), SigningKey(mustCreateUser()))
+		impostor = agents.new(AgentID("agent-1"), SigningKey(mustCreateUser()))
+		other = agents.new(SigningKey(mustCreateUser()))
+		policy := (&RulePolicy{DefaultAllow: true}).Allow("payments.>", owner.signingPub)
+		receiver = agents.new(TrustedKeys(owner.signingPub, impostor.signingPub, other.signingPub),
+			PublishPolicy(policy))
+		receiver.handleMessage(servicesList(owner, "payments.api", "10.0.0.1:80"))
+		Expect(receiver.Discover("payments.api", false)).To(HaveLen(1))
+	})
+
+	AfterEach(func() {
+		agents.close()
+	})
+
+	It("drops announcements the policy does not authorize", func() {
+		receiver.handleMessage(servicesList(other, "payments.db", "10.0.0.2:80"))
+		receiver.handleMessage(servicesList(other, "inventory", "10.0.0.3:80"))
+		Expect(receiver.Discover("payments.db", false)).To(BeEmpty())
+		Expect(receiver.Discover("inventory", false)).To(HaveLen(1))
+		Expect(receiver.UnauthorizedAnnouncements()).To(BeEquivalentTo(1))
+	})
+
+	It("binds a client ID to the first signer", func() {
+		Expect(receiver.owners).To(HaveKeyWithValue("agent-1", owner.signingPub))
+	})
+
+	It("rejects announcements for a client ID claimed by another signer", func() {
+		impostor.incarnation = owner.incarnation + 1
+		receiver.handleMessage(servicesList(impostor, "inventory", "10.0.0.2:80"))
+		Expect(receiver.Discover("inventory", false)).To(BeEmpty())
+		Expect(receiver.Discover("payments.api", false)).To(HaveLen(1))
+		Expect(receiver.UnauthorizedAnnouncements()).To(BeEquivalentTo(1))
+	})
+
+	It("rejects stop messages for a client ID claimed by another signer", func() {
+		receiver.handleMessage(message(impostor, impostor.stopSubject(),
+			&dproto.AgentStopped{AgentId: impostor.clientID, Incarnation: owner.incarnation}))
+		Expect(receiver.Discover("payments.api", false)).To(HaveLen(1))
+		Expect(receiver.UnauthorizedAnnouncements()).To(BeEquivalentTo(1))
+	})
+
+	It("accepts stop messages from the owner", func() {
+		receiver.handleMessage(message(owner, owner.stopSubject(),
+			&dproto.AgentStopped{AgentId: owner.clientID, Incarnation: owner.incarnation}))
+		Expect(receiver.Discover("payments.api", false)).To(BeEmpty())
+		Expect(receiver.UnauthorizedAnnouncements()).To(BeZero())
+	})
+
+	It("requires trusted keys", func() {
+		_, err := NewAgent(nil, PublishPolicy(&RulePolicy{}))
+		Expect(err).To(HaveOccurred())
+	})
+})
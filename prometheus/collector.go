@@ -0,0 +1,107 @@
+// Package prometheus exports statistics of a service discovery agent as
+// Prometheus metrics.
+package prometheus
+
+import (
+	"github.com/hatobito-io/discovery"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector collecting statistics of a
+// discovery.Agent.
+type Collector struct {
+	agent                     *discovery.Agent
+	connected                 *prometheus.Desc
+	running                   *prometheus.Desc
+	knownInstances            *prometheus.Desc
+	providedInstances         *prometheus.Desc
+	messagesSent              *prometheus.Desc
+	messagesReceived          *prometheus.Desc
+	decodeFailures            *prometheus.Desc
+	rejectedMessages          *prometheus.Desc
+	unauthorizedAnnouncements *prometheus.Desc
+	expirations               *prometheus.Desc
+	stopMessages              *prometheus.Desc
+	ejections                 *prometheus.Desc
+	sendQueueDepth            *prometheus.Desc
+}
+
+// NewCollector creates a Collector for the agent. Constant labels are added to
+// every metric, which allows registering collectors of several agents.
+func NewCollector(agent *discovery.Agent, constLabels prometheus.Labels) *Collector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc("discovery_"+name, help, labels, constLabels)
+	}
+	return &Collector{
+		agent:                     agent,
+		connected:                 desc("connected", "Whether the NATS connection is up."),
+		running:                   desc("running", "Whether the agent is started."),
+		knownInstances:            desc("known_instances", "Number of known remote instances.", "service"),
+		providedInstances:         desc("provided_instances", "Number of locally registered instances.", "service"),
+		messagesSent:              desc("messages_sent_total", "Number of published messages.", "type"),
+		messagesReceived:          desc("messages_received_total", "Number of messages received from other agents.", "type"),
+		decodeFailures:            desc("decode_failures_total", "Number of received messages which could not be decoded."),
+		rejectedMessages:          desc("rejected_messages_total", "Number of received messages which failed verification or decryption."),
+		unauthorizedAnnouncements: desc("unauthorized_announcements_total", "Number of service announcements dropped by the publish policy."),
+		expirations:               desc("expirations_total", "Number of remote instances forgotten because they were not updated in time."),
+		stopMessages:              desc("stop_messages_total", "Number of handled stop messages."),
+		ejections:                 desc("ejections_total", "Number of instance ejections by outlier detection."),
+		sendQueueDepth:            desc("send_queue_depth", "Number of messages waiting to be published."),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connected
+	ch <- c.running
+	ch <- c.knownInstances
+	ch <- c.providedInstances
+	ch <- c.messagesSent
+	ch <- c.messagesReceived
+	ch <- c.decodeFailures
+	ch <- c.rejectedMessages
+	ch <- c.unauthorizedAnnouncements
+	ch <- c.expirations
+	ch <- c.stopMessages
+	ch <- c.ejections
+	ch <- c.sendQueueDepth
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.agent.Stats()
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+	}
+	counter := func(desc *prometheus.Desc, value uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labels...)
+	}
+	gauge(c.connected, boolValue(stats.Connected))
+	gauge(c.running, boolValue(stats.Running))
+	for service, n := range stats.KnownInstances {
+		gauge(c.knownInstances, float64(n), service)
+	}
+	for service, n := range stats.ProvidedInstances {
+		gauge(c.providedInstances, float64(n), service)
+	}
+	for messageType, n := range stats.MessagesSent {
+		counter(c.messagesSent, n, messageType)
+	}
+	for messageType, n := range stats.MessagesReceived {
+		counter(c.messagesReceived, n, messageType)
+	}
+	counter(c.decodeFailures, stats.DecodeFailures)
+	counter(c.rejectedMessages, stats.RejectedMessages)
+	counter(c.unauthorizedAnnouncements, stats.UnauthorizedAnnouncements)
+	counter(c.expirations, stats.Expirations)
+	counter(c.stopMessages, stats.StopMessages)
+	counter(c.ejections, stats.Ejections)
+	gauge(c.sendQueueDepth, float64(stats.SendQueueDepth))
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
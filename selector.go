@@ -0,0 +1,276 @@
+package discovery
+
+import (
+	"fmt"
+	"strings"
+)
+
+type selectorOp int
+
+const (
+	opExists selectorOp = iota
+	opNotExists
+	opEquals
+	opNotEquals
+	opIn
+	opNotIn
+)
+
+type requirement struct {
+	key    string
+	op     selectorOp
+	values []string
+}
+
+func (r *requirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	switch r.op {
+	case opExists:
+		return ok
+	case opNotExists:
+		return !ok
+	case opEquals, opIn:
+		return ok && contains(r.values, value)
+	case opNotEquals, opNotIn:
+		return !ok || !contains(r.values, value)
+	}
+	return false
+}
+
+func (r *requirement) String() string {
+	switch r.op {
+	case opExists:
+		return r.key
+	case opNotExists:
+		return "!" + r.key
+	case opEquals:
+		return r.key + "=" + r.values[0]
+	case opNotEquals:
+		return r.key + "!=" + r.values[0]
+	case opIn:
+		return r.key + " in (" + strings.Join(r.values, ",") + ")"
+	case opNotIn:
+		return r.key + " notin (" + strings.Join(r.values, ",") + ")"
+	}
+	return ""
+}
+
+// Selector is a Kubernetes-style label selector matched against metadata of
+// service instances, see ParseSelector.
+type Selector struct {
+	requirements []requirement
+}
+
+// ParseSelector parses a label selector. A selector is a comma separated list
+// of requirements, all of which must be met:
+//
+//	key              the key is present
+//	!key             the key is absent
+//	key=value        the key has the value; "==" is accepted as well
+//	key!=value       the key is absent or has another value
+//	key in (a,b)     the key has one of the values
+//	key notin (a,b)  the key is absent or has none of the values
+//
+// For example "env=prod,tier in (web,api),!canary". An empty selector matches
+// everything.
+func ParseSelector(selector string) (*Selector, error) {
+	tokens, err := lexSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector %q: %v", selector, err)
+	}
+	p := &selectorParser{tokens: tokens}
+	ret := &Selector{}
+	for len(p.tokens) > 0 {
+		req, err := p.requirement()
+		if err != nil {
+			return nil, fmt.Errorf("invalid label selector %q: %v", selector, err)
+		}
+		ret.requirements = append(ret.requirements, req)
+		if len(p.tokens) > 0 {
+			if tok := p.next(); tok != "," {
+				return nil, fmt.Errorf("invalid label selector %q: expected \",\" but found %q", selector, tok)
+			}
+			if len(p.tokens) == 0 {
+				return nil, fmt.Errorf("invalid label selector %q: trailing \",\"", selector)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Matches reports whether the labels meet all requirements of the selector.
+func (s *Selector) Matches(labels map[string]string) bool {
+	for i := range s.requirements {
+		if !s.requirements[i].matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the selector in canonical form.
+func (s *Selector) String() string {
+	parts := make([]string, len(s.requirements))
+	for i := range s.requirements {
+		parts[i] = s.requirements[i].String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// WatchSelector is like Watch, but the Agent only keeps instances of the
+// service with metadata matching the label selector, see ParseSelector.
+// Watching the same service with other selectors or version constraints keeps
+// instances satisfying any of them, watching it with Watch keeps all
+// instances.
+func (a *Agent) WatchSelector(serviceName, selector string) error {
+	s, err := ParseSelector(selector)
+	if err != nil {
+		return err
+	}
+	return a.watchFiltered(serviceName, s.matchesInstance)
+}
+
+// DiscoverSelector is like Discover, but only returns instances with metadata
+// matching the label selector, see ParseSelector.
+func (a *Agent) DiscoverSelector(serviceName, selector string, includeLocal bool) ([]*ServiceInfo, error) {
+	s, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return filterInstances(a.discover(serviceName, includeLocal), s.matchesInstance), nil
+}
+
+// SelectorPicker returns a Picker choosing among instances with metadata
+// matching the label selector using next, which is WeightedPicker if nil.
+func SelectorPicker(selector string, next Picker) (Picker, error) {
+	s, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return filterPicker(s.matchesInstance, next), nil
+}
+
+func (s *Selector) matchesInstance(info *ServiceInfo) bool {
+	return s.Matches(info.Metadata)
+}
+
+func isSelectorIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '.' || c == '_' || c == '-' || c == '/'
+}
+
+// lexSelector splits a selector into identifiers and operators.
+func lexSelector(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == ',' || c == '(' || c == ')':
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case c == '=' || c == '!':
+			if i+1 < len(s) && s[i+1] == '=' {
+				tokens = append(tokens, s[i:i+2])
+				i += 2
+			} else {
+				tokens = append(tokens, s[i:i+1])
+				i++
+			}
+		case isSelectorIdentChar(c):
+			start := i
+			for i < len(s) && isSelectorIdentChar(s[i]) {
+				i++
+			}
+			tokens = append(tokens, s[start:i])
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+type selectorParser struct {
+	tokens []string
+}
+
+func (p *selectorParser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *selectorParser) next() string {
+	tok := p.peek()
+	if len(p.tokens) > 0 {
+		p.tokens = p.tokens[1:]
+	}
+	return tok
+}
+
+func (p *selectorParser) ident(what string) (string, error) {
+	tok := p.next()
+	if tok == "" || !isSelectorIdentChar(tok[0]) {
+		return "", fmt.Errorf("expected %s but found %q", what, tok)
+	}
+	return tok, nil
+}
+
+func (p *selectorParser) requirement() (requirement, error) {
+	if p.peek() == "!" {
+		p.next()
+		key, err := p.ident("key")
+		return requirement{key: key, op: opNotExists}, err
+	}
+	key, err := p.ident("key")
+	if err != nil {
+		return requirement{}, err
+	}
+	req := requirement{key: key}
+	switch op := p.peek(); op {
+	case "", ",":
+		req.op = opExists
+		return req, nil
+	case "=", "==", "!=":
+		p.next()
+		req.op = opEquals
+		if op == "!=" {
+			req.op = opNotEquals
+		}
+		value := ""
+		if tok := p.peek(); tok != "" && tok != "," {
+			if value, err = p.ident("value"); err != nil {
+				return req, err
+			}
+		}
+		req.values = []string{value}
+		return req, nil
+	case "in", "notin":
+		p.next()
+		req.op = opIn
+		if op == "notin" {
+			req.op = opNotIn
+		}
+		if tok := p.next(); tok != "(" {
+			return req, fmt.Errorf("expected \"(\" but found %q", tok)
+		}
+		for {
+			value, err := p.ident("value")
+			if err != nil {
+				return req, err
+			}
+			req.values = append(req.values, value)
+			tok := p.next()
+			if tok == ")" {
+				return req, nil
+			}
+			if tok != "," {
+				return req, fmt.Errorf("expected \",\" or \")\" but found %q", tok)
+			}
+		}
+	default:
+		return req, fmt.Errorf("expected operator but found %q", op)
+	}
+}
@@ -0,0 +1,70 @@
+package discovery
+
+import (
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseSelector", func() {
+	table.DescribeTable("parses valid selectors into canonical form",
+		func(selector, canonical string) {
+			s, err := ParseSelector(selector)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.String()).To(Equal(canonical))
+		},
+		table.Entry("empty", "", ""),
+		table.Entry("existence", "canary", "canary"),
+		table.Entry("absence", "!canary", "!canary"),
+		table.Entry("equality", "env=prod", "env=prod"),
+		table.Entry("double equality", "env==prod", "env=prod"),
+		table.Entry("inequality", "env != prod", "env!=prod"),
+		table.Entry("empty value", "env=", "env="),
+		table.Entry("set", "tier in (web, api)", "tier in (web,api)"),
+		table.Entry("negated set", "tier notin (web)", "tier notin (web)"),
+		table.Entry("qualified keys", "app.kubernetes.io/name=orders_v-2", "app.kubernetes.io/name=orders_v-2"),
+		table.Entry("several requirements", "env=prod, tier in (web,api),!canary", "env=prod,tier in (web,api),!canary"),
+	)
+
+	table.DescribeTable("rejects invalid selectors",
+		func(selector string) {
+			_, err := ParseSelector(selector)
+			Expect(err).To(HaveOccurred())
+		},
+		table.Entry("unexpected character", "env=prod;"),
+		table.Entry("missing key", "=prod"),
+		table.Entry("negated operator", "!env=prod"),
+		table.Entry("missing separator", "env=prod tier=web"),
+		table.Entry("leading comma", ",env"),
+		table.Entry("trailing comma", "env,"),
+		table.Entry("set without parentheses", "tier in web"),
+		table.Entry("empty set", "tier in ()"),
+		table.Entry("unterminated set", "tier in (web"),
+		table.Entry("set with trailing comma", "tier in (web,)"),
+		table.Entry("unknown operator", "tier like web"),
+		table.Entry("lone negation", "!"),
+	)
+
+	table.DescribeTable("matches labels",
+		func(selector string, labels map[string]string, matches bool) {
+			s, err := ParseSelector(selector)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.Matches(labels)).To(Equal(matches))
+		},
+		table.Entry("empty selector matches everything", "", nil, true),
+		table.Entry("existence", "canary", map[string]string{"canary": ""}, true),
+		table.Entry("existence of a missing key", "canary", map[string]string{}, false),
+		table.Entry("absence", "!canary", map[string]string{"env": "prod"}, true),
+		table.Entry("absence of a present key", "!canary", map[string]string{"canary": "true"}, false),
+		table.Entry("equality", "env=prod", map[string]string{"env": "prod"}, true),
+		table.Entry("equality with another value", "env=prod", map[string]string{"env": "dev"}, false),
+		table.Entry("equality of a missing key", "env=prod", nil, false),
+		table.Entry("inequality of a missing key", "env!=prod", nil, true),
+		table.Entry("inequality", "env!=prod", map[string]string{"env": "prod"}, false),
+		table.Entry("set", "tier in (web,api)", map[string]string{"tier": "api"}, true),
+		table.Entry("set without the value", "tier in (web,api)", map[string]string{"tier": "db"}, false),
+		table.Entry("negated set of a missing key", "tier notin (web)", nil, true),
+		table.Entry("negated set", "tier notin (web)", map[string]string{"tier": "web"}, false),
+		table.Entry("all requirements", "env=prod,!canary", map[string]string{"env": "prod", "canary": "1"}, false),
+	)
+})
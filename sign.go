@@ -0,0 +1,146 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dproto "github.com/hatobito-io/discovery/proto"
+	"github.com/nats-io/nkeys"
+)
+
+// DefaultSignatureWindow is the default maximum difference between the time a
+// signed message was signed at and the time it is received, see
+// SignatureWindow.
+const DefaultSignatureWindow = 30 * time.Second
+
+var (
+	errUntrustedKey = errors.New("message is signed by untrusted key")
+	errStale        = errors.New("message is outside of the signature window")
+	errReplayed     = errors.New("message is replayed")
+)
+
+// replayGuard rejects replayed signed messages. Every signed message carries a
+// timestamp, which strictly increases with every message of an agent.
+// Messages too far from the current time are rejected, as well as messages not
+// newer than the last one received on the same subject. Messages published on
+// the same subject by one agent are delivered in order, while messages on
+// different subjects may be delivered by different subscriptions. It has its
+// own lock, as messages are verified in NATS subscription handlers.
+type replayGuard struct {
+	window time.Duration
+	mu     sync.Mutex
+	sent   int64
+	last   map[string]int64
+}
+
+func newReplayGuard() *replayGuard {
+	return &replayGuard{window: DefaultSignatureWindow, last: make(map[string]int64)}
+}
+
+// next returns the timestamp of the next message sent.
+func (g *replayGuard) next() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ts := time.Now().UnixNano()
+	if ts <= g.sent {
+		ts = g.sent + 1
+	}
+	g.sent = ts
+	return ts
+}
+
+func (g *replayGuard) check(subject string, ts int64) error {
+	now := time.Now()
+	if t := time.Unix(0, ts); t.Before(now.Add(-g.window)) || t.After(now.Add(g.window)) {
+		return errStale
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if ts <= g.last[subject] {
+		return errReplayed
+	}
+	g.last[subject] = ts
+	return nil
+}
+
+// prune forgets subjects without messages within the window, as any replay
+// of their messages is stale anyway.
+func (g *replayGuard) prune(now time.Time) {
+	limit := now.Add(-g.window).UnixNano()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for subject, ts := range g.last {
+		if ts < limit {
+			delete(g.last, subject)
+		}
+	}
+}
+
+// signed reports whether messages exchanged by the Agent are wrapped into
+// SignedMessage envelopes.
+func (a *Agent) signed() bool {
+	return a.signingKey != nil || a.trustedKeys != nil
+}
+
+// signedData returns the data covered by the signature. Subject is included so
+// that a signed message can not be replayed on behalf of another agent, the
+// timestamp so that it can not be replayed later.
+func signedData(subject string, timestamp int64, payload []byte) []byte {
+	data := make([]byte, 0, len(subject)+9+len(payload))
+	data = append(data, subject...)
+	data = append(data, 0)
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(timestamp))
+	data = append(data, ts[:]...)
+	return append(data, payload...)
+}
+
+func (a *Agent) sign(subject string, payload []byte) ([]byte, error) {
+	envelope := &dproto.SignedMessage{Payload: payload, Timestamp: a.replay.next()}
+	if a.signingKey != nil {
+		sig, err := a.signingKey.Sign(signedData(subject, envelope.Timestamp, payload))
+		if err != nil {
+			return nil, err
+		}
+		envelope.Signature = sig
+		envelope.PublicKey = a.signingPub
+	}
+	return proto.Marshal(envelope)
+}
+
+// verify unwraps the envelope and returns the payload along with the public
+// key of the signer.
+func (a *Agent) verify(subject string, data []byte) ([]byte, string, error) {
+	envelope := &dproto.SignedMessage{}
+	if err := proto.Unmarshal(data, envelope); err != nil {
+		return nil, "", err
+	}
+	if a.trustedKeys == nil {
+		return envelope.Payload, "", nil
+	}
+	if !a.trustedKeys[envelope.PublicKey] && envelope.PublicKey != a.signingPub {
+		return nil, "", errUntrustedKey
+	}
+	key, err := nkeys.FromPublicKey(envelope.PublicKey)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := key.Verify(signedData(subject, envelope.Timestamp, envelope.Payload), envelope.Signature); err != nil {
+		return nil, "", err
+	}
+	if err := a.replay.check(subject, envelope.Timestamp); err != nil {
+		return nil, "", err
+	}
+	return envelope.Payload, envelope.PublicKey, nil
+}
+
+// RejectedMessages returns the number of messages rejected by the Agent because
+// they were not signed, signature verification failed, they were replayed or
+// they could not be decrypted.
+func (a *Agent) RejectedMessages() uint64 {
+	return atomic.LoadUint64(&a.stats.rejected)
+}
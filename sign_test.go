@@ -0,0 +1,139 @@
+package discovery
+
+import (
+	"time"
+
+	dproto "github.com/hatobito-io/discovery/proto"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/proto"
+)
+
+var _ = Describe("Signed messages", func() {
+	var (
+		agents   testAgents
+		sender   *Agent
+		receiver *Agent
+	)
+
+	BeforeEach(func() {
+		sender = agents.new(SigningKey(mustCreateUser()))
+		receiver = agents.new(SigningKey(mustCreateUser()), TrustedKeys(sender.signingPub))
+	})
+
+	AfterEach(func() {
+		agents.close()
+	})
+
+	It("accepts messages signed by trusted keys", func() {
+		receiver.handleMessage(servicesList(sender, "orders", "10.0.0.1:80"))
+		Expect(receiver.Discover("orders", false)).To(HaveLen(1))
+		Expect(receiver.RejectedMessages()).To(BeZero())
+	})
+
+	It("rejects unsigned messages", func() {
+		data, err := proto.Marshal(&dproto.ServicesList{
+			Services: []*dproto.ServiceInfoProto{{Name: "orders", Address: "10.0.0.1:80"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		receiver.handleMessage(&nats.Msg{Subject: sender.serviceListSubject(), Data: data})
+		Expect(receiver.Discover("orders", false)).To(BeEmpty())
+		Expect(receiver.RejectedMessages()).To(BeEquivalentTo(1))
+	})
+
+	It("rejects messages signed by untrusted keys", func() {
+		forger := agents.new(SigningKey(mustCreateUser()))
+		receiver.handleMessage(servicesList(forger, "orders", "10.0.0.1:80"))
+		Expect(receiver.Discover("orders", false)).To(BeEmpty())
+		Expect(receiver.RejectedMessages()).To(BeEquivalentTo(1))
+	})
+
+	It("rejects messages with a forged signer", func() {
+		msg := servicesList(agents.new(SigningKey(mustCreateUser())), "orders", "10.0.0.1:80")
+		envelope := &dproto.SignedMessage{}
+		Expect(proto.Unmarshal(msg.Data, envelope)).To(Succeed())
+		envelope.PublicKey = sender.signingPub
+		data, err := proto.Marshal(envelope)
+		Expect(err).NotTo(HaveOccurred())
+		msg.Data = data
+		receiver.handleMessage(msg)
+		Expect(receiver.Discover("orders", false)).To(BeEmpty())
+		Expect(receiver.RejectedMessages()).To(BeEquivalentTo(1))
+	})
+
+	It("rejects messages moved to another subject", func() {
+		msg := servicesList(sender, "orders", "10.0.0.1:80")
+		msg.Subject = sender.agentInfoSubject()
+		receiver.handleMessage(msg)
+		Expect(receiver.RejectedMessages()).To(BeEquivalentTo(1))
+	})
+
+	It("rejects messages replayed within the signature window", func() {
+		msg := servicesList(sender, "orders", "10.0.0.1:80")
+		receiver.handleMessage(msg)
+		receiver.handleMessage(msg)
+		Expect(receiver.RejectedMessages()).To(BeEquivalentTo(1))
+	})
+
+	It("rejects messages older than the last one on the subject", func() {
+		older := servicesList(sender, "orders", "10.0.0.1:80")
+		newer := servicesList(sender, "orders", "10.0.0.2:80")
+		receiver.handleMessage(newer)
+		receiver.handleMessage(older)
+		Expect(receiver.RejectedMessages()).To(BeEquivalentTo(1))
+		instances := receiver.Discover("orders", false)
+		Expect(instances).To(HaveLen(1))
+		Expect(instances[0].Address).To(Equal("10.0.0.2:80"))
+	})
+})
+
+var _ = Describe("replayGuard", func() {
+	var guard *replayGuard
+
+	BeforeEach(func() {
+		guard = newReplayGuard()
+	})
+
+	It("issues strictly increasing timestamps", func() {
+		previous := guard.next()
+		for i := 0; i < 100; i++ {
+			ts := guard.next()
+			Expect(ts).To(BeNumerically(">", previous))
+			previous = ts
+		}
+	})
+
+	It("accepts every message once", func() {
+		ts := guard.next()
+		Expect(guard.check("subject", ts)).To(Succeed())
+		Expect(guard.check("subject", ts)).To(Equal(errReplayed))
+	})
+
+	It("tracks subjects separately", func() {
+		first, second := guard.next(), guard.next()
+		Expect(guard.check("a", second)).To(Succeed())
+		Expect(guard.check("b", first)).To(Succeed())
+		Expect(guard.check("a", first)).To(Equal(errReplayed))
+	})
+
+	It("rejects messages outside the window", func() {
+		now := time.Now()
+		Expect(guard.check("subject", now.Add(-DefaultSignatureWindow-time.Second).UnixNano())).To(Equal(errStale))
+		Expect(guard.check("subject", now.Add(DefaultSignatureWindow+time.Second).UnixNano())).To(Equal(errStale))
+	})
+
+	It("forgets subjects without recent messages", func() {
+		ts := guard.next()
+		Expect(guard.check("subject", ts)).To(Succeed())
+		guard.prune(time.Now().Add(DefaultSignatureWindow + time.Second))
+		Expect(guard.last).To(BeEmpty())
+	})
+})
+
+func mustCreateUser() nkeys.KeyPair {
+	key, err := nkeys.CreateUser()
+	Expect(err).NotTo(HaveOccurred())
+	return key
+}
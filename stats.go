@@ -0,0 +1,130 @@
+package discovery
+
+import "sync/atomic"
+
+// Message types exchanged by agents. These are used as keys in
+// Stats.MessagesSent and Stats.MessagesReceived.
+const (
+	MessageInterest         = "interest"
+	MessageServiceList      = "servicelist"
+	MessageStop             = "stop"
+	MessageAgentInfo        = "agentinfo"
+	MessageAgentInfoRequest = "inforequest"
+)
+
+var messageTypes = [...]string{
+	MessageInterest,
+	MessageServiceList,
+	MessageStop,
+	MessageAgentInfo,
+	MessageAgentInfoRequest,
+}
+
+// agentStats holds the counters updated atomically by the Agent. It must be the
+// first field of Agent to guarantee 64-bit alignment of the counters.
+type agentStats struct {
+	sent           [len(messageTypes)]uint64
+	received       [len(messageTypes)]uint64
+	decodeFailures uint64
+	rejected       uint64
+	unauthorized   uint64
+	expirations    uint64
+	stopMessages   uint64
+	ejections      uint64
+}
+
+func messageTypeIndex(messageType string) int {
+	for i, t := range messageTypes {
+		if t == messageType {
+			return i
+		}
+	}
+	return -1
+}
+
+func (a *Agent) countSent(subject string) {
+	_, messageType, _, ok := a.splitSubject(subject)
+	if !ok {
+		return
+	}
+	if i := messageTypeIndex(messageType); i >= 0 {
+		atomic.AddUint64(&a.stats.sent[i], 1)
+	}
+}
+
+func (a *Agent) countReceived(messageType string) {
+	if i := messageTypeIndex(messageType); i >= 0 {
+		atomic.AddUint64(&a.stats.received[i], 1)
+	}
+}
+
+// Stats is a snapshot of the Agent's state and counters. It is meant to be
+// exported to a monitoring system, see the prometheus subpackage for an
+// example.
+type Stats struct {
+	// Connected reports whether the NATS connection is up.
+	Connected bool
+	// Running reports whether the Agent is started.
+	Running bool
+	// KnownInstances is the number of known remote instances per service.
+	KnownInstances map[string]int
+	// ProvidedInstances is the number of locally registered instances per
+	// service.
+	ProvidedInstances map[string]int
+	// MessagesSent is the number of published messages per message type.
+	MessagesSent map[string]uint64
+	// MessagesReceived is the number of messages received from other agents
+	// per message type.
+	MessagesReceived map[string]uint64
+	// DecodeFailures is the number of received messages which could not be
+	// decoded.
+	DecodeFailures uint64
+	// RejectedMessages is the number of received messages which failed
+	// signature verification or decryption.
+	RejectedMessages uint64
+	// UnauthorizedAnnouncements is the number of service announcements
+	// dropped by the publish policy.
+	UnauthorizedAnnouncements uint64
+	// Expirations is the number of remote instances forgotten because they
+	// were not updated in time.
+	Expirations uint64
+	// StopMessages is the number of handled stop messages from other agents.
+	StopMessages uint64
+	// Ejections is the number of times an instance was ejected by outlier
+	// detection.
+	Ejections uint64
+	// SendQueueDepth is the number of messages waiting to be published.
+	SendQueueDepth int
+}
+
+// Stats returns a snapshot of the Agent's state and counters.
+func (a *Agent) Stats() *Stats {
+	stats := &Stats{
+		KnownInstances:            make(map[string]int),
+		ProvidedInstances:         make(map[string]int),
+		MessagesSent:              make(map[string]uint64),
+		MessagesReceived:          make(map[string]uint64),
+		DecodeFailures:            atomic.LoadUint64(&a.stats.decodeFailures),
+		RejectedMessages:          atomic.LoadUint64(&a.stats.rejected),
+		UnauthorizedAnnouncements: atomic.LoadUint64(&a.stats.unauthorized),
+		Expirations:               atomic.LoadUint64(&a.stats.expirations),
+		StopMessages:              atomic.LoadUint64(&a.stats.stopMessages),
+		Ejections:                 atomic.LoadUint64(&a.stats.ejections),
+	}
+	for i, t := range messageTypes {
+		stats.MessagesSent[t] = atomic.LoadUint64(&a.stats.sent[i])
+		stats.MessagesReceived[t] = atomic.LoadUint64(&a.stats.received[i])
+	}
+	a.lock()
+	defer a.unlock()
+	stats.Connected = a.connected
+	stats.Running = a.running
+	stats.SendQueueDepth = len(a.send)
+	for item := a.knownServices.first; item != nil; item = item.next {
+		stats.KnownInstances[item.Name]++
+	}
+	for item := a.providedServices.first; item != nil; item = item.next {
+		stats.ProvidedInstances[item.Name]++
+	}
+	return stats
+}
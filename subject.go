@@ -1,7 +1,7 @@
 package discovery
 
 import (
-	"strings"
+	"sync/atomic"
 
 	dproto "github.com/hatobito-io/discovery/proto"
 	"github.com/nats-io/nats.go"
@@ -9,42 +9,79 @@ import (
 )
 
 func (a *Agent) serviceListSubject() string {
-	return a.subjectPrefix + ".servicelist." + a.clientID
+	return a.namespacePrefix(a.namespace) + "." + MessageServiceList + "." + a.clientID
 }
 
 func (a *Agent) stopSubject() string {
-	return a.subjectPrefix + ".stop." + a.clientID
+	return a.namespacePrefix(a.namespace) + "." + MessageStop + "." + a.clientID
 }
 
-func (a *Agent) interestSubject() string {
-	return a.subjectPrefix + ".interest." + a.clientID
+// interestSubjects returns the subjects interest messages are sent to, which
+// include the discoverable namespaces, so that agents there reply at once.
+func (a *Agent) interestSubjects() []string {
+	subjects := []string{a.namespacePrefix(a.namespace) + "." + MessageInterest + "." + a.clientID}
+	for _, namespace := range a.otherNamespaces() {
+		subjects = append(subjects, a.namespacePrefix(namespace)+"."+MessageInterest+"."+a.clientID)
+	}
+	return subjects
+}
+
+func (a *Agent) agentInfoSubject() string {
+	return a.namespacePrefix(a.namespace) + "." + MessageAgentInfo + "." + a.clientID
 }
 
-func (a *Agent) parseNatsMessage(msg *nats.Msg) (proto.Message, string, bool) {
-	parts := strings.Split(msg.Subject, ".")
-	nParts := len(parts)
-	matched := nParts > a.prefixParts+1 &&
-		strings.Join(parts[:a.prefixParts], ".") == a.subjectPrefix
+func (a *Agent) agentInfoRequestSubject() string {
+	return a.namespacePrefix(a.namespace) + "." + MessageAgentInfoRequest + "." + a.clientID
+}
+
+func (a *Agent) parseNatsMessage(msg *nats.Msg) (result proto.Message, clientID, identity, namespace string, myself bool) {
+	namespace, action, clientID, matched := a.splitSubject(msg.Subject)
 	if !matched {
-		return nil, "", false
+		return nil, "", "", "", false
 	}
-	action := parts[a.prefixParts]
-	clientID := strings.Join(parts[a.prefixParts+1:], ".")
-	myself := clientID == a.clientID
-	var result proto.Message
+	myself = clientID == a.clientID
 	switch action {
-	case "interest":
+	case MessageInterest:
 		result = &dproto.ServiceInterest{}
-	case "servicelist":
+	case MessageServiceList:
 		result = &dproto.ServicesList{}
-	case "stop":
+	case MessageStop:
 		result = &dproto.AgentStopped{}
+	case MessageAgentInfo:
+		result = &dproto.AgentInfo{}
+	case MessageAgentInfoRequest:
+		result = &dproto.AgentInfoRequest{}
 	}
 	if result == nil {
-		return nil, clientID, myself
+		return nil, clientID, "", namespace, myself
+	}
+	data := msg.Data
+	if a.signed() {
+		var err error
+		data, identity, err = a.verify(msg.Subject, data)
+		if err != nil {
+			if !myself {
+				atomic.AddUint64(&a.stats.rejected, 1)
+				a.log.Warn("discovery: rejected message", "subject", msg.Subject, "clientID", clientID, "error", err)
+			}
+			return nil, clientID, "", namespace, myself
+		}
+	}
+	if a.loadKeyring() != nil {
+		var err error
+		data, err = a.decrypt(msg.Subject, data)
+		if err != nil {
+			if !myself {
+				atomic.AddUint64(&a.stats.rejected, 1)
+				a.log.Warn("discovery: failed to decrypt message", "subject", msg.Subject, "clientID", clientID, "error", err)
+			}
+			return nil, clientID, identity, namespace, myself
+		}
 	}
-	if err := proto.Unmarshal(msg.Data, result); err != nil {
-		return nil, clientID, myself
+	if err := proto.Unmarshal(data, result); err != nil {
+		atomic.AddUint64(&a.stats.decodeFailures, 1)
+		a.log.Warn("discovery: failed to decode message", "subject", msg.Subject, "clientID", clientID, "error", err)
+		return nil, clientID, identity, namespace, myself
 	}
-	return result, clientID, myself
+	return result, clientID, identity, namespace, myself
 }
@@ -0,0 +1,92 @@
+package discovery
+
+import (
+	"context"
+
+	dproto "github.com/hatobito-io/discovery/proto"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/hatobito-io/discovery"
+
+var (
+	attrService   = attribute.Key("discovery.service")
+	attrInstances = attribute.Key("discovery.instances")
+	attrClientID  = attribute.Key("discovery.client_id")
+	attrPeer      = attribute.Key("discovery.peer.client_id")
+	attrAddress   = attribute.Key("discovery.address")
+	attrSubject   = attribute.Key("messaging.destination")
+	attrSystem    = attribute.Key("messaging.system").String("nats")
+)
+
+// headerCarrier adapts nats.Header to propagation.TextMapCarrier.
+type headerCarrier nats.Header
+
+func (c headerCarrier) Get(key string) string {
+	return nats.Header(c).Get(key)
+}
+
+func (c headerCarrier) Set(key string, value string) {
+	nats.Header(c).Set(key, value)
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (a *Agent) tracer() trace.Tracer {
+	if a.tracerProvider != nil {
+		return a.tracerProvider.Tracer(instrumentationName)
+	}
+	return otel.Tracer(instrumentationName)
+}
+
+// injectHeaders returns NATS headers carrying the trace context of ctx, or nil
+// if there is nothing to propagate or the server does not support headers.
+func (a *Agent) injectHeaders(ctx context.Context) nats.Header {
+	if ctx == nil || !trace.SpanContextFromContext(ctx).IsValid() || !a.conn.HeadersSupported() {
+		return nil
+	}
+	header := nats.Header{}
+	a.propagator().Inject(ctx, headerCarrier(header))
+	return header
+}
+
+// startHandlerSpan starts a span for handling of a received message, using the
+// trace context propagated in the message headers as the parent.
+func (a *Agent) startHandlerSpan(msg *nats.Msg, decoded interface{}, clientID string) (context.Context, trace.Span) {
+	ctx := context.Background()
+	if msg.Header != nil {
+		ctx = a.propagator().Extract(ctx, headerCarrier(msg.Header))
+	}
+	attrs := []attribute.KeyValue{
+		attrSystem,
+		attrSubject.String(msg.Subject),
+		attrClientID.String(a.clientID),
+		attrPeer.String(clientID),
+	}
+	switch decoded := decoded.(type) {
+	case *dproto.ServiceInterest:
+		attrs = append(attrs, attrService.StringSlice(decoded.ServiceName))
+	case *dproto.ServicesList:
+		attrs = append(attrs, attrInstances.Int(len(decoded.Services)))
+	}
+	return a.tracer().Start(ctx, "discovery.handle "+messageType(decoded),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attrs...))
+}
+
+func (a *Agent) propagator() propagation.TextMapPropagator {
+	if a.textPropagator != nil {
+		return a.textPropagator
+	}
+	return otel.GetTextMapPropagator()
+}
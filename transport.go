@@ -0,0 +1,275 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTransportDomain is the default domain of service host names handled
+// by Transport.
+const DefaultTransportDomain = "disco"
+
+const (
+	// DefaultTransportWatchTTL is the default time after which services
+	// watched because of requests are unwatched if not requested again.
+	DefaultTransportWatchTTL = 10 * time.Minute
+	// DefaultTransportMaxWatches is the default limit of services watched
+	// because of requests.
+	DefaultTransportMaxWatches = 1000
+)
+
+// Transport is an http.RoundTripper sending requests for host names of the
+// form "<service>.<domain>" to instances of the service picked from the
+// Agent's known services. Requests for other hosts are passed to Base as is.
+//
+// If connecting to an instance fails, the request is retried with a different
+// instance. Requests with a body are only retried if the body can be
+// recreated with GetBody. Results of requests are reported to the Agent with
+// ReportResult: errors and responses with 5xx status codes are failures, which
+// makes instances ejected if the Agent uses OutlierDetection.
+//
+// Services are watched when first requested. Services the application did not
+// watch itself are unwatched when not requested for WatchTTL.
+type Transport struct {
+	// Base performs the requests. If nil, http.DefaultTransport is used.
+	Base http.RoundTripper
+	// Picker chooses the instance for a request. If nil, WeightedPicker is
+	// used.
+	Picker Picker
+	// Endpoint is the name of the instance endpoint requests are sent to,
+	// see ServiceInfo.Endpoints. Instances without it are not used. If the
+	// endpoint has scheme http or https, it replaces the scheme of the
+	// request. If an instance has several endpoints with the name, e.g.
+	// IPv4 and IPv6 ones, they are tried in turn until one can be connected
+	// to. If empty, requests are sent to the instance Address.
+	Endpoint string
+	// MaxAttempts is the number of instances tried when connecting fails.
+	MaxAttempts int
+	// WaitTimeout is how long requests for a service wait for its instances
+	// to be discovered after the Transport started watching it.
+	WaitTimeout time.Duration
+	// WatchTTL is how long services stay watched after the last request.
+	WatchTTL time.Duration
+	// MaxWatches limits the number of services watched because of
+	// requests. Requests for further services fail.
+	MaxWatches int
+	agent      *Agent
+	suffix     string
+	mu         sync.Mutex
+	watched    map[string]*transportWatch
+	swept      time.Time
+}
+
+// transportWatch is a service requested through a Transport.
+type transportWatch struct {
+	since time.Time
+	used  time.Time
+	// own tells whether the Transport started watching the service, so
+	// it has to unwatch it.
+	own bool
+}
+
+// NewTransport creates a Transport handling host names in domain. If domain is
+// empty, DefaultTransportDomain is used.
+func NewTransport(agent *Agent, domain string) *Transport {
+	if domain == "" {
+		domain = DefaultTransportDomain
+	}
+	return &Transport{
+		MaxAttempts: 3,
+		WaitTimeout: DefaultUpdateInterval,
+		WatchTTL:    DefaultTransportWatchTTL,
+		MaxWatches:  DefaultTransportMaxWatches,
+		agent:       agent,
+		suffix:      "." + strings.Trim(domain, "."),
+		watched:     make(map[string]*transportWatch),
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	serviceName := strings.TrimSuffix(req.URL.Hostname(), t.suffix)
+	if serviceName == req.URL.Hostname() || serviceName == "" {
+		return base.RoundTrip(req)
+	}
+	if IsPattern(serviceName) {
+		return nil, errors.New("discovery: invalid service name " + serviceName)
+	}
+	ctx := req.Context()
+	picker := t.Picker
+	if t.Endpoint != "" {
+		picker = EndpointPicker(t.Endpoint, picker)
+	}
+	waitUntil, err := t.watch(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	var tried []string
+	var lastErr error
+	sent := 0
+	for len(tried) < t.MaxAttempts || len(tried) == 0 {
+		instance := t.agent.Pick(ctx, serviceName, picker, tried...)
+		if instance == nil && lastErr == nil {
+			instance = t.wait(ctx, serviceName, picker, waitUntil)
+		}
+		if instance == nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, errors.New("discovery: no instances of service " + serviceName)
+		}
+		start := time.Now()
+		resp, err := t.send(base, req, instance, &sent)
+		if err == errNotRewindable {
+			return nil, lastErr
+		}
+		if ctx.Err() == nil {
+			success := err == nil && resp.StatusCode < http.StatusInternalServerError
+			t.agent.ReportResult(instance, success, time.Since(start))
+		}
+		if err == nil || !isDialError(err) {
+			return resp, err
+		}
+		t.agent.log.Warn("discovery: connecting to service instance failed",
+			"service", serviceName, "address", instance.Address, "error", err)
+		tried = append(tried, instance.Address)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+var errNotRewindable = errors.New("discovery: request body can not be sent again")
+
+// send sends the request to the instance. If the instance has several
+// addresses for the endpoint, e.g. IPv4 and IPv6 ones, they are tried in turn
+// until one can be connected to. sent counts requests sent so far, as their
+// bodies have to be recreated.
+func (t *Transport) send(base http.RoundTripper, req *http.Request, instance *ServiceInfo, sent *int) (*http.Response, error) {
+	var endpoints []Endpoint
+	if t.Endpoint != "" {
+		endpoints = instance.NamedEndpoints(t.Endpoint)
+	}
+	var lastErr error
+	for i := 0; i == 0 || i < len(endpoints); i++ {
+		outreq := req.Clone(req.Context())
+		outreq.Host = ""
+		if len(endpoints) > 0 {
+			setEndpoint(outreq.URL, &endpoints[i])
+		} else {
+			setAddress(outreq.URL, instance.Address)
+		}
+		if *sent > 0 && req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				if lastErr != nil {
+					return nil, lastErr
+				}
+				return nil, errNotRewindable
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			outreq.Body = body
+		}
+		*sent++
+		resp, err := base.RoundTrip(outreq)
+		if err == nil || !isDialError(err) {
+			return resp, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// watch starts watching the service if needed and returns the time until
+// which requests wait for its instances. Services not requested for WatchTTL
+// are unwatched.
+func (t *Transport) watch(ctx context.Context, serviceName string) (time.Time, error) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.swept) > t.WatchTTL/10 {
+		t.swept = now
+		for name, w := range t.watched {
+			if now.Sub(w.used) > t.WatchTTL {
+				delete(t.watched, name)
+				if w.own {
+					t.agent.Unwatch(name)
+				}
+			}
+		}
+	}
+	if w := t.watched[serviceName]; w != nil {
+		w.used = now
+		return w.since.Add(t.WaitTimeout), nil
+	}
+	if len(t.watched) >= t.MaxWatches {
+		return time.Time{}, errors.New("discovery: too many watched services")
+	}
+	w := &transportWatch{since: now, used: now, own: !t.agent.Watching(serviceName)}
+	if w.own {
+		if err := t.agent.WatchContext(ctx, serviceName); err != nil {
+			return time.Time{}, err
+		}
+	}
+	t.watched[serviceName] = w
+	return w.since.Add(t.WaitTimeout), nil
+}
+
+// wait waits until an instance of the service is known or the deadline
+// passes, and returns the picked instance.
+func (t *Transport) wait(ctx context.Context, serviceName string, picker Picker, deadline time.Time) *ServiceInfo {
+	ch := make(chan string, 10)
+	t.agent.Notify(ch)
+	defer t.agent.StopNotify(ch)
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		if instance := t.agent.Pick(ctx, serviceName, picker); instance != nil {
+			return instance
+		}
+		select {
+		case <-ch:
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// setAddress points u to address, which is either host:port or a URL.
+func setAddress(u *url.URL, address string) {
+	if strings.Contains(address, "://") {
+		if parsed, err := url.Parse(address); err == nil {
+			u.Scheme = parsed.Scheme
+			u.Host = parsed.Host
+			return
+		}
+	}
+	u.Host = address
+}
+
+func setEndpoint(u *url.URL, e *Endpoint) {
+	if e.Scheme == "http" || e.Scheme == "https" {
+		u.Scheme = e.Scheme
+	}
+	u.Host = e.Address()
+}
+
+// isDialError reports whether err happened while connecting, before the request
+// was sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
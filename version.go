@@ -0,0 +1,50 @@
+package discovery
+
+import "github.com/Masterminds/semver/v3"
+
+// versionFilter returns a filter accepting instances with versions satisfying
+// the constraint. Instances without a valid version satisfy no constraint.
+func versionFilter(constraint string) (func(*ServiceInfo) bool, error) {
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return nil, err
+	}
+	return func(info *ServiceInfo) bool {
+		version, err := semver.NewVersion(info.Version)
+		return err == nil && c.Check(version)
+	}, nil
+}
+
+// WatchVersion is like Watch, but the Agent only keeps instances of the service
+// with versions satisfying the semantic version constraint, e.g. ">=2.1 <3".
+// Watching the same service with other constraints or selectors keeps
+// instances satisfying any of them, watching it with Watch keeps all
+// instances.
+func (a *Agent) WatchVersion(serviceName, constraint string) error {
+	filter, err := versionFilter(constraint)
+	if err != nil {
+		return err
+	}
+	return a.watchFiltered(serviceName, filter)
+}
+
+// DiscoverVersion is like Discover, but only returns instances with versions
+// satisfying the semantic version constraint, e.g. ">=2.1 <3".
+func (a *Agent) DiscoverVersion(serviceName, constraint string, includeLocal bool) ([]*ServiceInfo, error) {
+	filter, err := versionFilter(constraint)
+	if err != nil {
+		return nil, err
+	}
+	return filterInstances(a.discover(serviceName, includeLocal), filter), nil
+}
+
+// VersionPicker returns a Picker choosing among instances with versions
+// satisfying the semantic version constraint using next, which is
+// WeightedPicker if nil.
+func VersionPicker(constraint string, next Picker) (Picker, error) {
+	filter, err := versionFilter(constraint)
+	if err != nil {
+		return nil, err
+	}
+	return filterPicker(filter, next), nil
+}
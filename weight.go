@@ -0,0 +1,123 @@
+package discovery
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// DefaultWeight is the weight of instances registered without weight.
+const DefaultWeight = 100
+
+// SetWeight changes the weight of a registered instance and announces the
+// change to other agents immediately. This allows shifting traffic gradually,
+// e.g. for canary rollouts. Weight 0 drains the instance: weighted pickers
+// only choose it if all preferred instances have weight 0.
+func (a *Agent) SetWeight(info *ServiceInfo, weight uint32) error {
+	return a.modify(info, func(item *ServiceInfo) { item.Weight = weight })
+}
+
+// SetPriority changes the priority of a registered instance and announces the
+// change to other agents immediately.
+func (a *Agent) SetPriority(info *ServiceInfo, priority uint32) error {
+	return a.modify(info, func(item *ServiceInfo) { item.Priority = priority })
+}
+
+func (a *Agent) modify(info *ServiceInfo, fn func(*ServiceInfo)) error {
+	key := a.providedKey(info)
+	a.lock()
+	defer a.unlock()
+	item := a.findProvided(key)
+	if item == nil {
+		return errNotRegistered(info)
+	}
+	fn(item)
+	a.changed(item.Name)
+	a.announce(item)
+	return nil
+}
+
+func errNotRegistered(info *ServiceInfo) error {
+	return errors.New("service instance " + info.Name + " at " + info.Address + " is not registered")
+}
+
+// bestPriority returns the instances with the lowest priority value.
+func bestPriority(instances []*ServiceInfo) []*ServiceInfo {
+	if len(instances) == 0 {
+		return nil
+	}
+	best := instances[0].Priority
+	for _, item := range instances[1:] {
+		if item.Priority < best {
+			best = item.Priority
+		}
+	}
+	ret := make([]*ServiceInfo, 0, len(instances))
+	for _, item := range instances {
+		if item.Priority == best {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
+// WeightedPicker returns a Picker choosing instances at random in proportion
+// to their weights. Only instances with the lowest priority value are
+// considered, so instances with higher values only get traffic when all the
+// preferred ones are gone or ejected.
+func WeightedPicker() Picker {
+	return PickerFunc(func(instances []*ServiceInfo) *ServiceInfo {
+		return pickWeighted(instances, func(item *ServiceInfo) float64 {
+			return float64(item.Weight)
+		})
+	})
+}
+
+// slowStartMinFactor is the fraction of its weight a new instance starts with.
+const slowStartMinFactor = 0.1
+
+// SlowStartPicker returns a Picker like WeightedPicker, except that an
+// instance's weight is ramped up linearly from a tenth to full over window
+// after the Agent first sees it. This protects new instances from full traffic
+// while their caches are cold.
+func SlowStartPicker(window time.Duration) Picker {
+	return PickerFunc(func(instances []*ServiceInfo) *ServiceInfo {
+		now := time.Now()
+		return pickWeighted(instances, func(item *ServiceInfo) float64 {
+			weight := float64(item.Weight)
+			age := now.Sub(item.FirstSeen)
+			if window <= 0 || age >= window {
+				return weight
+			}
+			factor := float64(age) / float64(window)
+			if factor < slowStartMinFactor {
+				factor = slowStartMinFactor
+			}
+			return weight * factor
+		})
+	})
+}
+
+func pickWeighted(instances []*ServiceInfo, weight func(*ServiceInfo) float64) *ServiceInfo {
+	instances = bestPriority(instances)
+	if len(instances) == 0 {
+		return nil
+	}
+	weights := make([]float64, len(instances))
+	var total float64
+	for i, item := range instances {
+		weights[i] = weight(item)
+		total += weights[i]
+	}
+	if total <= 0 {
+		return instances[rand.Intn(len(instances))]
+	}
+	n := rand.Float64() * total
+	for i, item := range instances {
+		n -= weights[i]
+		if n < 0 {
+			return item
+		}
+	}
+	return instances[len(instances)-1]
+}
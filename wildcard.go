@@ -0,0 +1,56 @@
+package discovery
+
+import (
+	"errors"
+	"strings"
+)
+
+// IsPattern reports whether the service name contains NATS wildcards, i.e.
+// whether Watch and Discover treat it as a pattern. Names received from
+// untrusted sources, such as DNS queries, should be checked with it.
+func IsPattern(name string) bool {
+	for _, token := range strings.Split(name, ".") {
+		if token == "*" || token == ">" {
+			return true
+		}
+	}
+	return false
+}
+
+// validPattern checks that a service name or pattern has no empty tokens and
+// that ">" is only used as the last token.
+func validPattern(pattern string) error {
+	tokens := strings.Split(pattern, ".")
+	for i, token := range tokens {
+		if token == "" || token == ">" && i != len(tokens)-1 {
+			return errors.New("invalid service name pattern " + pattern)
+		}
+	}
+	return nil
+}
+
+// matchName reports whether a service name matches a name or pattern given to
+// Watch or Discover.
+func MatchName(pattern, name string) bool {
+	return pattern == name || IsPattern(pattern) && matchPattern(pattern, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if MatchName(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWatched reports whether the service is matched by any watched name or
+// pattern. Must be called with the lock held.
+func (a *Agent) isWatched(name string) bool {
+	for pattern := range a.watched {
+		if MatchName(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
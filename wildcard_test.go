@@ -0,0 +1,98 @@
+package discovery
+
+import (
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Wildcards", func() {
+	table.DescribeTable("MatchName",
+		func(pattern, name string, matches bool) {
+			Expect(MatchName(pattern, name)).To(Equal(matches))
+		},
+		table.Entry("equal names", "payments", "payments", true),
+		table.Entry("different names", "payments", "orders", false),
+		table.Entry("prefix of a name", "payments", "payments.api", false),
+		table.Entry("\"*\" matches one token", "payments.*", "payments.api", true),
+		table.Entry("\"*\" does not match several tokens", "payments.*", "payments.api.v2", false),
+		table.Entry("\"*\" does not match no token", "payments.*", "payments", false),
+		table.Entry("\"*\" in the middle", "*.api", "payments.api", true),
+		table.Entry("\">\" matches one token", "payments.>", "payments.api", true),
+		table.Entry("\">\" matches several tokens", "payments.>", "payments.api.v2", true),
+		table.Entry("\">\" does not match no token", "payments.>", "payments", false),
+		table.Entry("\">\" alone matches everything", ">", "payments.api", true),
+		table.Entry("wildcards in names are not patterns", "payments.api", "payments.*", false),
+		table.Entry("partial tokens are not wildcards", "pay*", "payments", false),
+	)
+
+	table.DescribeTable("IsPattern",
+		func(name string, pattern bool) {
+			Expect(IsPattern(name)).To(Equal(pattern))
+		},
+		table.Entry("plain name", "payments.api", false),
+		table.Entry("\"*\" token", "payments.*", true),
+		table.Entry("\">\" token", "payments.>", true),
+		table.Entry("\"*\" inside a token", "pay*.api", false),
+	)
+
+	table.DescribeTable("validPattern",
+		func(pattern string, valid bool) {
+			if valid {
+				Expect(validPattern(pattern)).To(Succeed())
+			} else {
+				Expect(validPattern(pattern)).NotTo(Succeed())
+			}
+		},
+		table.Entry("name", "payments.api", true),
+		table.Entry("\"*\" anywhere", "*.api.*", true),
+		table.Entry("\">\" last", "payments.>", true),
+		table.Entry("\">\" not last", "payments.>.api", false),
+		table.Entry("empty", "", false),
+		table.Entry("empty token", "payments..api", false),
+		table.Entry("trailing dot", "payments.", false),
+	)
+
+	Describe("Watch", func() {
+		var (
+			agents   testAgents
+			sender   *Agent
+			receiver *Agent
+		)
+
+		BeforeEach(func() {
+			sender = agents.new()
+			receiver = agents.new()
+		})
+
+		AfterEach(func() {
+			agents.close()
+		})
+
+		It("rejects invalid patterns", func() {
+			Expect(receiver.Watch("payments.>.api")).NotTo(Succeed())
+			Expect(receiver.Watching("payments.>.api")).To(BeFalse())
+		})
+
+		It("discovers instances of all matching services", func() {
+			Expect(receiver.Watch("payments.*")).To(Succeed())
+			receiver.handleMessage(servicesList(sender, "payments.api", "10.0.0.1:80"))
+			receiver.handleMessage(servicesList(sender, "payments.db", "10.0.0.2:80"))
+			receiver.handleMessage(servicesList(sender, "orders", "10.0.0.3:80"))
+			Expect(receiver.Discover("payments.*", false)).To(HaveLen(2))
+			Expect(receiver.Discover("payments.>", false)).To(HaveLen(2))
+			Expect(receiver.Discover("payments.api", false)).To(HaveLen(1))
+		})
+
+		It("keeps services matched by other watched patterns on Unwatch", func() {
+			Expect(receiver.Watch("payments.*")).To(Succeed())
+			Expect(receiver.Watch("*.api")).To(Succeed())
+			receiver.handleMessage(servicesList(sender, "payments.api", "10.0.0.1:80"))
+			receiver.handleMessage(servicesList(sender, "payments.db", "10.0.0.2:80"))
+			receiver.Unwatch("payments.*")
+			Expect(receiver.Discover(">", false)).To(ConsistOf(
+				WithTransform(func(info *ServiceInfo) string { return info.Name }, Equal("payments.api")),
+			))
+		})
+	})
+})